@@ -0,0 +1,544 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	// amqpPoolSize - default number of idle publishing channels kept open
+	amqpPoolSize = 16
+	// amqpReturnsSize - returned messages buffered before they are dropped
+	amqpReturnsSize = 128
+)
+
+// AMQPTransport - RabbitMQ transport based on streadway/amqp
+type AMQPTransport struct {
+	uri  string
+	conn *amqp.Connection
+
+	// channel for topology declarations and browsing, streadway does not match
+	// replies of concurrent calls on channel, so calls are serialized by calls mutex
+	channel *amqp.Channel
+	calls   sync.Mutex
+
+	mutex     sync.Mutex
+	consumers map[string]*amqp.Channel
+
+	// channels of cancelled consumers stay open until their deliveries are acknowledged
+	canceled []*amqp.Channel
+
+	// idle publishing channels, confirm mode channels are pooled separately
+	size    int
+	pool    []*amqpPublisher
+	confirm []*amqpPublisher
+
+	returns chan Return
+}
+
+// amqpPublisher - publishing channel owned by single publish call at a time
+type amqpPublisher struct {
+	conn     *amqp.Connection
+	channel  *amqp.Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
+	closed   chan *amqp.Error
+}
+
+type amqpAcknowledger struct {
+	channel *amqp.Channel
+}
+
+// NewAMQPTransport - create transport connecting to broker by uri
+func NewAMQPTransport(uri string) *AMQPTransport {
+	return &AMQPTransport{
+		uri:       uri,
+		consumers: make(map[string]*amqp.Channel),
+		size:      amqpPoolSize,
+		returns:   make(chan Return, amqpReturnsSize),
+	}
+}
+
+// SetPoolSize - set number of idle publishing channels kept open for reuse
+func (t *AMQPTransport) SetPoolSize(size int) {
+	t.mutex.Lock()
+	t.size = size
+	t.mutex.Unlock()
+}
+
+func (t *AMQPTransport) Dial() error {
+	var err error
+
+	conn, err := amqp.Dial(t.uri)
+	if err != nil {
+		return err
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("Channel: %s", err)
+	}
+
+	// channels of previous connection are closed with it
+	t.mutex.Lock()
+	t.conn = conn
+	t.channel = channel
+	t.pool, t.confirm, t.canceled = nil, nil, nil
+	t.mutex.Unlock()
+
+	return nil
+}
+
+// connection returns current broker connection, it is nil before dial
+func (t *AMQPTransport) connection() *amqp.Connection {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	return t.conn
+}
+
+// call runs synchronous method on topology channel, one call at a time
+func (t *AMQPTransport) call(f func(channel *amqp.Channel) error) error {
+
+	t.calls.Lock()
+	defer t.calls.Unlock()
+
+	t.mutex.Lock()
+	channel := t.channel
+	t.mutex.Unlock()
+
+	if channel == nil {
+		return ERRNOTCONNECTED
+	}
+
+	return f(channel)
+}
+
+func (t *AMQPTransport) NotifyClose() <-chan error {
+	closed := make(chan error, 1)
+	notify := t.connection().NotifyClose(make(chan *amqp.Error, 1))
+
+	go func() {
+		if err, ok := <-notify; ok && err != nil {
+			closed <- err
+			return
+		}
+		closed <- nil
+	}()
+
+	return closed
+}
+
+func (t *AMQPTransport) NotifyReturn() <-chan Return {
+	return t.returns
+}
+
+// Close closes publishing, consumer and topology channels and then connection
+func (t *AMQPTransport) Close() error {
+
+	t.mutex.Lock()
+	channels := make([]*amqp.Channel, 0, len(t.pool)+len(t.confirm)+len(t.consumers)+1)
+	for _, p := range append(t.pool, t.confirm...) {
+		channels = append(channels, p.channel)
+	}
+	for _, c := range t.consumers {
+		channels = append(channels, c)
+	}
+	channels = append(channels, t.canceled...)
+	t.pool, t.confirm, t.canceled = nil, nil, nil
+	t.consumers = make(map[string]*amqp.Channel)
+	channel, conn := t.channel, t.conn
+	t.mutex.Unlock()
+
+	if conn == nil {
+		return ERRNOTCONNECTED
+	}
+
+	for _, c := range channels {
+		c.Close()
+	}
+
+	if channel != nil {
+		channel.Close()
+	}
+
+	return conn.Close()
+}
+
+func (t *AMQPTransport) ExchangeDeclare(name, kind string) error {
+	return t.call(func(c *amqp.Channel) error {
+		return c.ExchangeDeclare(name, kind, true, false, false, false, nil)
+	})
+}
+
+func (t *AMQPTransport) ExchangeDelete(name string) error {
+	return t.call(func(c *amqp.Channel) error {
+		return c.ExchangeDelete(name, false, true)
+	})
+}
+
+func (t *AMQPTransport) QueueDeclare(q Queue) (string, error) {
+	var name string
+	err := t.call(func(c *amqp.Channel) error {
+		queue, err := c.QueueDeclare(q.Name, q.Durable, q.AutoDelete, q.Exclusive, false, amqp.Table(q.Args))
+		name = queue.Name
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (t *AMQPTransport) QueueBind(queue, key, exchange string) error {
+	return t.call(func(c *amqp.Channel) error {
+		return c.QueueBind(queue, key, exchange, false, nil)
+	})
+}
+
+func (t *AMQPTransport) QueueDelete(name string) error {
+	return t.call(func(c *amqp.Channel) error {
+		_, err := c.QueueDelete(name, false, false, true)
+		return err
+	})
+}
+
+func (t *AMQPTransport) Publish(ctx context.Context, exchange, key string, msg Publishing) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p, err := t.publish(false, func(p *amqpPublisher) error {
+		return p.channel.Publish(exchange, key, msg.Mandatory, false, publishing(msg))
+	})
+	if err != nil {
+		return err
+	}
+
+	t.release(p)
+	return nil
+}
+
+func (t *AMQPTransport) PublishConfirm(ctx context.Context, exchange, key string, msg Publishing) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	p, err := t.publish(true, func(p *amqpPublisher) error {
+		return p.channel.Publish(exchange, key, msg.Mandatory, false, publishing(msg))
+	})
+	if err != nil {
+		return err
+	}
+
+	select {
+	case c, ok := <-p.confirms:
+		if !ok {
+			// channel is closed by broker, for example when exchange does not exist
+			if err, ok := <-p.closed; ok && err != nil {
+				return err
+			}
+			return ERRNOTCONNECTED
+		}
+		// broker sends return before confirm of unroutable message, returns are drained
+		// before channel is released, so they are not taken by the next publish
+		returned := false
+		for drained := false; !drained; {
+			select {
+			case r := <-p.returns:
+				returned = returned || r.CorrelationId == msg.CorrelationID
+			default:
+				drained = true
+			}
+		}
+
+		t.release(p)
+		if !c.Ack {
+			return ERRPUBLISHNACK
+		}
+		if returned {
+			return ERRNOROUTE
+		}
+		return nil
+	case <-ctx.Done():
+		// late confirm would be taken by the next publish, so channel is not reused
+		p.channel.Close()
+		return ctx.Err()
+	}
+}
+
+// publish sends message with send on idle publishing channel and returns the channel.
+// Broker closes channel asynchronously, for example on publish to missing exchange,
+// so pooled channel can be closed already, then it is dropped and message is sent
+// once more on new channel
+func (t *AMQPTransport) publish(confirm bool, send func(*amqpPublisher) error) (*amqpPublisher, error) {
+
+	if p := t.idle(confirm); p != nil {
+		err := send(p)
+		if err == nil {
+			return p, nil
+		}
+		if err != amqp.ErrClosed {
+			p.channel.Close()
+			return nil, err
+		}
+	}
+
+	p, err := t.open(confirm)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := send(p); err != nil {
+		p.channel.Close()
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// idle takes publishing channel from pool, it returns nil when pool is empty
+func (t *AMQPTransport) idle(confirm bool) *amqpPublisher {
+
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	pool := &t.pool
+	if confirm {
+		pool = &t.confirm
+	}
+
+	for len(*pool) > 0 {
+		p := (*pool)[len(*pool)-1]
+		*pool = (*pool)[:len(*pool)-1]
+
+		select {
+		case <-p.closed:
+			// channel closed by broker, open another one
+			continue
+		default:
+		}
+
+		return p
+	}
+
+	return nil
+}
+
+// open opens new publishing channel
+func (t *AMQPTransport) open(confirm bool) (*amqpPublisher, error) {
+
+	t.mutex.Lock()
+	conn := t.conn
+	t.mutex.Unlock()
+
+	if conn == nil {
+		return nil, ERRNOTCONNECTED
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("Channel: %s", err)
+	}
+
+	p := &amqpPublisher{
+		conn:    conn,
+		channel: channel,
+		closed:  channel.NotifyClose(make(chan *amqp.Error, 1)),
+	}
+
+	returns := channel.NotifyReturn(make(chan amqp.Return, 1))
+
+	if confirm {
+		if err = channel.Confirm(false); err != nil {
+			channel.Close()
+			return nil, fmt.Errorf("Channel confirm: %s", err)
+		}
+		p.confirms = channel.NotifyPublish(make(chan amqp.Confirmation, 1))
+		p.returns = returns
+		return p, nil
+	}
+
+	go t.returned(returns)
+
+	return p, nil
+}
+
+// returned passes messages returned to publishing channel to transport returns,
+// returns are dropped when nobody reads them to not block connection
+func (t *AMQPTransport) returned(returns <-chan amqp.Return) {
+	for r := range returns {
+		select {
+		case t.returns <- Return{
+			Publishing: Publishing{
+				ContentType:   r.ContentType,
+				CorrelationID: r.CorrelationId,
+				ReplyTo:       r.ReplyTo,
+				Headers:       map[string]interface{}(r.Headers),
+				Body:          r.Body,
+			},
+			Exchange: r.Exchange,
+			Key:      r.RoutingKey,
+			Reason:   r.ReplyText,
+		}:
+		default:
+		}
+	}
+}
+
+// release returns publishing channel to pool, channels of closed
+// connection and channels over pool size are closed
+func (t *AMQPTransport) release(p *amqpPublisher) {
+
+	t.mutex.Lock()
+	pool := &t.pool
+	if p.confirms != nil {
+		pool = &t.confirm
+	}
+
+	if p.conn == t.conn && len(*pool) < t.size {
+		*pool = append(*pool, p)
+		t.mutex.Unlock()
+		return
+	}
+	t.mutex.Unlock()
+
+	p.channel.Close()
+}
+
+func (t *AMQPTransport) Consume(queue, consumer string, limit int) (<-chan Delivery, error) {
+
+	conn := t.connection()
+	if conn == nil {
+		return nil, ERRNOTCONNECTED
+	}
+
+	channel, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("Channel: %s", err)
+	}
+
+	if err = channel.Qos(limit, 0, false); err != nil {
+		return nil, fmt.Errorf("Channel: %s", err)
+	}
+
+	msgs, err := channel.Consume(queue, consumer, false, false, false, false, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	t.mutex.Lock()
+	t.consumers[consumer] = channel
+	t.mutex.Unlock()
+
+	ack := &amqpAcknowledger{channel}
+	deliveries := make(chan Delivery)
+
+	go func() {
+		for d := range msgs {
+			deliveries <- delivery(d, ack)
+		}
+		close(deliveries)
+	}()
+
+	return deliveries, nil
+}
+
+func (t *AMQPTransport) Cancel(consumer string) error {
+
+	t.mutex.Lock()
+	channel, ok := t.consumers[consumer]
+	delete(t.consumers, consumer)
+	if ok {
+		t.canceled = append(t.canceled, channel)
+	}
+	t.mutex.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	return channel.Cancel(consumer, false)
+}
+
+func (t *AMQPTransport) Get(queue string) (Delivery, bool, error) {
+
+	var (
+		d  amqp.Delivery
+		ok bool
+	)
+
+	// acknowledgements are asynchronous, so delivery is acknowledged outside of call
+	var ack *amqpAcknowledger
+	err := t.call(func(c *amqp.Channel) error {
+		var err error
+		d, ok, err = c.Get(queue, false)
+		ack = &amqpAcknowledger{c}
+		return err
+	})
+	if err != nil || !ok {
+		return Delivery{}, false, err
+	}
+
+	return delivery(d, ack), true, nil
+}
+
+func delivery(d amqp.Delivery, ack Acknowledger) Delivery {
+
+	// expiration property is string with number of milliseconds
+	var expiration time.Duration
+	if ms, err := strconv.ParseInt(d.Expiration, 10, 64); err == nil {
+		expiration = time.Duration(ms) * time.Millisecond
+	}
+
+	return Delivery{
+		Publishing: Publishing{
+			ContentType:   d.ContentType,
+			CorrelationID: d.CorrelationId,
+			ReplyTo:       d.ReplyTo,
+			Headers:       map[string]interface{}(d.Headers),
+			Body:          d.Body,
+			Priority:      d.Priority,
+			Expiration:    expiration,
+			Timestamp:     d.Timestamp,
+		},
+		ConsumerTag:  d.ConsumerTag,
+		DeliveryTag:  d.DeliveryTag,
+		Acknowledger: ack,
+	}
+}
+
+func publishing(msg Publishing) amqp.Publishing {
+
+	p := amqp.Publishing{
+		ContentType:   msg.ContentType,
+		CorrelationId: msg.CorrelationID,
+		ReplyTo:       msg.ReplyTo,
+		Headers:       amqp.Table(msg.Headers),
+		Body:          msg.Body,
+		Priority:      msg.Priority,
+		Timestamp:     msg.Timestamp,
+	}
+
+	if msg.Expiration > 0 {
+		p.Expiration = strconv.FormatInt(msg.Expiration.Milliseconds(), 10)
+	}
+
+	return p
+}
+
+func (a *amqpAcknowledger) Ack(tag uint64) error {
+	return a.channel.Ack(tag, false)
+}
+
+func (a *amqpAcknowledger) Nack(tag uint64, requeue bool) error {
+	return a.channel.Nack(tag, false, requeue)
+}
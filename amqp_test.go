@@ -0,0 +1,149 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func benchTransport(b *testing.B) *AMQPTransport {
+
+	uri := fmt.Sprintf("amqp://%s:%s@%s:%s/",
+		os.Getenv("AMQP_USER"), os.Getenv("AMQP_PASS"), os.Getenv("AMQP_HOST"), os.Getenv("AMQP_PORT"))
+
+	t := NewAMQPTransport(uri)
+	if err := t.Dial(); err != nil {
+		b.Skip("Broker is not available:", err)
+	}
+
+	return t
+}
+
+func TestAMQPNotConnected(t *testing.T) {
+
+	tr := NewAMQPTransport("")
+
+	if _, err := tr.QueueDeclare(Queue{Name: "test"}); err != ERRNOTCONNECTED {
+		t.Errorf("Expected error: %s got %v", ERRNOTCONNECTED, err)
+	}
+
+	if _, _, err := tr.Get("test"); err != ERRNOTCONNECTED {
+		t.Errorf("Expected error: %s got %v", ERRNOTCONNECTED, err)
+	}
+
+	if _, err := tr.Consume("test", "test", 1); err != ERRNOTCONNECTED {
+		t.Errorf("Expected error: %s got %v", ERRNOTCONNECTED, err)
+	}
+}
+
+func TestAMQPPublishClosedChannel(t *testing.T) {
+
+	tr := NewAMQPTransport("")
+
+	pooled := &amqpPublisher{closed: make(chan *amqp.Error, 1)}
+	tr.pool = append(tr.pool, pooled)
+
+	// open pooled channel is reused
+	p, err := tr.publish(false, func(p *amqpPublisher) error { return nil })
+	if err != nil || p != pooled {
+		t.Fatalf("Expected pooled channel reused, got %v %v", p, err)
+	}
+	tr.release(p)
+
+	// pooled channel closed by broker is dropped and message is sent on new channel
+	var sent []*amqpPublisher
+	_, err = tr.publish(false, func(p *amqpPublisher) error {
+		sent = append(sent, p)
+		return amqp.ErrClosed
+	})
+
+	// transport is not connected, so new channel can not be opened
+	if err != ERRNOTCONNECTED {
+		t.Errorf("Expected error: %s got %v", ERRNOTCONNECTED, err)
+	}
+	if len(sent) != 1 || sent[0] != pooled {
+		t.Errorf("Expected message sent on pooled channel once, got %d", len(sent))
+	}
+	if len(tr.pool) != 0 {
+		t.Errorf("Expected closed channel dropped from pool, got %d", len(tr.pool))
+	}
+}
+
+// BenchmarkPublishChannelPerMessage - publishing with new channel for every message
+func BenchmarkPublishChannelPerMessage(b *testing.B) {
+
+	t := benchTransport(b)
+	defer t.Close()
+
+	msg := publishing(Publishing{Body: []byte("{}")})
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		channel, err := t.conn.Channel()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := channel.Publish("", "test-bench", false, false, msg); err != nil {
+			b.Fatal(err)
+		}
+		channel.Close()
+	}
+}
+
+// BenchmarkPublishPooled - publishing with pooled channels
+func BenchmarkPublishPooled(b *testing.B) {
+
+	t := benchTransport(b)
+	defer t.Close()
+
+	ctx := context.Background()
+	msg := Publishing{Body: []byte("{}")}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := t.Publish(ctx, "", "test-bench", msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkPublishPooledParallel - concurrent publishing with pooled channels
+func BenchmarkPublishPooledParallel(b *testing.B) {
+
+	t := benchTransport(b)
+	defer t.Close()
+
+	ctx := context.Background()
+	msg := Publishing{Body: []byte("{}")}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := t.Publish(ctx, "", "test-bench", msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkPublishConfirmPooled - call mode publishing waiting for broker confirms
+func BenchmarkPublishConfirmPooled(b *testing.B) {
+
+	t := benchTransport(b)
+	defer t.Close()
+
+	ctx := context.Background()
+	msg := Publishing{Body: []byte("{}")}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if err := t.PublishConfirm(ctx, "", "test-bench", msg); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -1,53 +1,78 @@
 package rpc
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"strings"
 	"time"
 
-	"github.com/streadway/amqp"
 	"github.com/satori/go.uuid"
 )
 
+// gatherBuffer - broadcast replies buffered while they are collected
+const gatherBuffer = 64
+
 func (r *RPC) listen() {
+	// attempt counts connect attempts in a row, it starts over when connection is lost
 	var attempt int
 
 	for {
 		select {
-		case <-r.done:
+		case <-r.ctx.Done():
 			return
 		case <-r.connect:
-			if r.online == false {
-				log.Println("Can not start listening while RPC should be offline")
-				return
-			}
-			if attempt >= 60 {
-				log.Println("attempt limit reached: 5")
+			if !r.online.Load() {
+				r.logger.Warn("can not start listening while RPC should be offline", Field{"name", r.name})
 				return
 			}
-			attempt++
-			log.Printf("RPC: %s connect", r.name)
+			attempt = 1
+			r.logger.Info("connect", Field{"name", r.name})
 			go r.dial()
 
-		case <-r.reconnect:
-			if r.online == false {
-				log.Println("Can not start listening while RPC should be offline")
+		case err := <-r.reconnect:
+			if !r.online.Load() {
+				r.logger.Warn("can not start listening while RPC should be offline", Field{"name", r.name})
 				return
 			}
-			log.Printf("RPC: %s reconnect", r.name)
-			timer := time.NewTimer(time.Second)
-			<-timer.C
-			go r.dial()
-			timer.Stop()
+			if r.policy.exhausted(attempt) {
+				r.logger.Error("connect attempt limit reached", Field{"name", r.name}, Field{"attempts", attempt}, fieldErr(err))
+				r.status.giveUp(err)
+				if r.policy.OnGiveUp != nil {
+					r.policy.OnGiveUp(err)
+				}
+				return
+			}
+
+			delay := r.policy.delay(attempt)
+			attempt++
+			r.logger.Info("reconnect", Field{"name", r.name}, Field{"attempt", attempt}, Field{"delay", delay})
+			// reconnects are counted once per retried dial, dial after lost connection is not a retry
+			r.metrics.reconnect()
+			r.status.reconnect()
+
+			go func() {
+				timer := time.NewTimer(delay)
+				defer timer.Stop()
+
+				select {
+				case <-timer.C:
+					r.dial()
+				case <-r.ctx.Done():
+				}
+			}()
 		}
 	}
 }
 
-func (r *RPC) dial() {
-	log.Println("RPC: DIAL:", r.name)
-	var err error
+// defaultTransport sets AMQP transport connected by URI when transport is not set,
+// it is called by Listen before any routine uses transport
+func (r *RPC) defaultTransport() {
+
+	if r.transport != nil {
+		return
+	}
 
 	if r.uri == "" {
 		AMQP_USER := os.Getenv("AMQP_USER")
@@ -58,45 +83,174 @@ func (r *RPC) dial() {
 		r.uri = fmt.Sprintf("amqp://%s:%s@%s:%s/", AMQP_USER, AMQP_PASS, AMQP_HOST, AMQP_PORT)
 	}
 
-	log.Println("RPC: Dial to:", r.uri)
-	r.conn, err = amqp.Dial(r.uri)
+	// uri is not logged as it carries broker credentials
+	r.logger.Debug("dial amqp", Field{"name", r.name})
+	r.transport = NewAMQPTransport(r.uri)
+}
 
-	if err != nil {
-		log.Println("RPC: Dial error", err)
-		r.reconnect <- true
+func (r *RPC) dial() {
+	r.logger.Debug("dial", Field{"name", r.name})
+
+	if err := r.transport.Dial(); err != nil {
+		r.logger.Error("dial failed", Field{"name", r.name}, fieldErr(err))
+		r.status.disconnect(err)
+		select {
+		case r.reconnect <- err:
+		case <-r.ctx.Done():
+		}
 		return
 	}
 
+	r.returns.Do(func() {
+		go r.returned(r.transport.NotifyReturn())
+	})
+
+	r.status.connect()
+
+	closed := r.transport.NotifyClose()
 	go func() {
-		if r.online == false {
+		err := <-closed
+		r.status.disconnect(err)
+		if !r.online.Load() {
 			return
 		}
-		log.Println("RPC: Closing:", r.name, <-r.conn.NotifyClose(make(chan *amqp.Error)))
-		r.connect <- true
+		r.logger.Warn("connection closed", Field{"name", r.name}, fieldErr(err))
+		select {
+		case r.connect <- true:
+		case <-r.ctx.Done():
+		}
 	}()
 
-	r.subscribe()
-	r.connected <- true
+	err := r.subscribe()
+	if err != nil {
+		r.logger.Error("subscribe failed", Field{"name", r.name}, fieldErr(err))
+	}
+	r.status.subscribe(err)
+
+	// connected is signalled without blocking, signal is kept until it is read
+	select {
+	case r.connected <- true:
+	default:
+	}
 }
 
-func (r *RPC) call(s Sender, d Destination, p Receiver, data []byte) error {
-	return r.publish(true, s, d, p, data)
+func (r *RPC) call(ctx context.Context, s Sender, d Destination, p Receiver, contentType string, data []byte) error {
+	return r.publish(ctx, true, s, d, p, contentType, data, "")
 }
 
-func (r *RPC) cast(s Sender, d Destination, p Receiver, data []byte) error {
-	return r.publish(false, s, d, p, data)
+func (r *RPC) cast(ctx context.Context, s Sender, d Destination, p Receiver, contentType string, data []byte) error {
+	return r.publish(ctx, false, s, d, p, contentType, data, "")
 }
 
-func (r *RPC) publish(call bool, s Sender, d Destination, p Receiver, data []byte) error {
+func (r *RPC) request(ctx context.Context, s Sender, d Destination, p Receiver, contentType string, data []byte) (reply, error) {
 
-	body, _ := r.encode(s, d, p, data)
+	id := uuid.NewV4().String()
 
-	log.Printf("PRC: publish to %s:%s, proxy: %s:%s, send: %dB body (%s)", d.Name, d.UUID, p.Name, p.UUID, len(body), body)
+	wait, done := r.wait(id, 1)
+	defer done()
 
-	channel, err := r.conn.Channel()
-	if err != nil {
-		return fmt.Errorf("Channel: %s", err)
+	if err := r.publish(ctx, true, s, d, p, contentType, data, id); err != nil {
+		return reply{}, err
+	}
+
+	select {
+	case rp := <-wait:
+		return rp, rp.err
+	case <-ctx.Done():
+		return reply{}, ctx.Err()
 	}
+}
+
+// gather publishes request to all instances of destination application
+// and collects their replies by instance uuid
+func (r *RPC) gather(ctx context.Context, s Sender, d Destination, contentType string, data []byte, expected int) (map[string]Reply, error) {
+
+	id := uuid.NewV4().String()
+
+	// replies are not waited for one by one, so channel holds replies arriving at once
+	size := expected
+	if size < gatherBuffer {
+		size = gatherBuffer
+	}
+	wait, done := r.wait(id, size)
+	defer done()
+
+	// broadcast is routed through topic exchange like cast to all instances
+	d.UUID, d.All = "", true
+	if err := r.publish(ctx, false, s, d, Receiver{}, contentType, data, id); err != nil {
+		return nil, err
+	}
+
+	replies := make(map[string]Reply)
+
+	for expected <= 0 || len(replies) < expected {
+		select {
+		case rp := <-wait:
+			replies[rp.sender.UUID] = Reply{
+				Sender:      rp.sender,
+				ContentType: rp.contentType,
+				Data:        rp.data,
+				Err:         rp.err,
+			}
+		case <-ctx.Done():
+			if expected > 0 {
+				return replies, ctx.Err()
+			}
+			return replies, nil
+		}
+	}
+
+	return replies, nil
+}
+
+// wait registers caller waiting for replies with correlation id,
+// returned func is called once caller stops waiting
+func (r *RPC) wait(id string, size int) (chan reply, func()) {
+
+	w := waiter{
+		replies: make(chan reply, size),
+		done:    make(chan struct{}),
+	}
+
+	r.mutex.Lock()
+	r.pending[id] = w
+	r.mutex.Unlock()
+
+	return w.replies, func() {
+		r.mutex.Lock()
+		delete(r.pending, id)
+		r.mutex.Unlock()
+		close(w.done)
+	}
+}
+
+func (r *RPC) publish(ctx context.Context, call bool, s Sender, d Destination, p Receiver, contentType string, data []byte, correlation string) error {
+
+	m := &Message{
+		Sender:      s,
+		Destination: d,
+		Receiver:    p,
+		ContentType: contentType,
+		Body:        data,
+		Call:        call,
+	}
+
+	return r.publisher(func(ctx context.Context, m *Message) error {
+		return r.send(ctx, m, correlation)
+	})(ctx, m)
+}
+
+// send encodes message and publishes it to transport
+func (r *RPC) send(ctx context.Context, m *Message, correlation string) error {
+
+	// do not publish messages nobody waits for anymore
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s, d, p := m.Sender, m.Destination, m.Receiver
+
+	body, _ := r.encode(s, d, p, m.Body)
 
 	exchange := fmt.Sprintf("%s:%s", d.Name, "direct")
 	if d.All {
@@ -122,260 +276,478 @@ func (r *RPC) publish(call bool, s Sender, d Destination, p Receiver, data []byt
 		}
 	}
 
-	if call {
+	if m.Call {
 		bind += ":call"
 	} else {
 		bind += ":cast"
 	}
 
 	bind = strings.ToLower(bind)
-	log.Println("RPC: publish to exchange:", exchange, bind)
 
-	if err := channel.Publish(exchange, bind, false, false, amqp.Publishing{
-		ContentType: "application/json",
+	r.logger.Debug("publish", append([]Field{
+		fieldSender(s),
+		fieldDestination(d),
+		fieldHandler(d.Handler),
+		{"receiver", p.Name + ":" + p.UUID},
+		{"exchange", exchange},
+		{"key", bind},
+		{"size", len(body)},
+	}, r.payload(m.Body)...)...)
+
+	// unroutable messages are returned instead of being dropped by broker
+	msg := Publishing{
+		ContentType: m.ContentType,
+		Headers:     r.signed(make(map[string]interface{})),
 		Body:        body,
-	},
-	); err != nil {
-		return fmt.Errorf("Exchange Publish: %s", err)
+		Mandatory:   true,
+		Priority:    Priority(ctx),
+		Expiration:  r.expiration(ctx, d),
+		Timestamp:   time.Now(),
 	}
+	msg.Headers[headerPublishedAt] = msg.Timestamp.UnixNano()
 
-	log.Println("RPC: published")
-	return nil
-}
+	// pass caller deadline to the receiver handler context
+	if deadline, ok := ctx.Deadline(); ok {
+		msg.Headers["deadline"] = deadline.UnixNano()
+	}
 
-func (r *RPC) subscribe() error {
-	var err error
-	var done = make(chan error)
+	end := r.inject(ctx, m, msg.Headers)
 
-	u := uuid.NewV4()
+	// failures are reported below, so producer span is ended and publish is counted
+	var err error
 
-	r.exchanges.direct = fmt.Sprintf("%s:%s", r.name, "direct")
-	r.exchanges.topic = fmt.Sprintf("%s:%s", r.name, "topic")
+	if correlation != "" {
+		msg.ReplyTo = r.queueNames().reply
+		msg.CorrelationID = correlation
+		if msg.ReplyTo == "" {
+			err = ERRNOREPLYQUEUE
+		}
+	}
 
-	r.queues.common = fmt.Sprintf("%s:%s", r.name, "direct")
-	r.queues.direct = fmt.Sprintf("%s:%s:%s", r.name, r.uuid, "direct")
-	r.queues.topic = fmt.Sprintf("%s:%s:%s", r.name,  u.String(), "topic")
+	// correlation id matches returned call message with its publishing
+	if m.Call && msg.CorrelationID == "" {
+		msg.CorrelationID = uuid.NewV4().String()
+	}
 
-	// Get hostname for register current instance
-	log.Printf("RPC: Create new consumer: %s", r.name)
+	// scheduled message waits in delay queue until it is passed to exchange
+	if sc, ok := ctx.Value(scheduleKey).(*schedule); ok && err == nil {
+		exchange, bind, err = r.delay(sc, exchange, bind, &msg)
+	}
 
-	r.channels.common, err = r.conn.Channel()
+	if err == nil {
+		err = r.confirm(ctx, m.Call, exchange, bind, msg)
+	}
+	r.metrics.publish(d, m.Call, err)
+	end(err)
 	if err != nil {
-		log.Println("Channel:", err)
-		return err
+		r.logger.Error("publish failed", fieldDestination(d), fieldHandler(d.Handler), fieldErr(err))
+		return fmt.Errorf("Exchange Publish: %w", err)
 	}
 
-	err = r.channels.common.Qos(r.limit, 0, false)
-	if err != nil {
-		log.Println("Channel:", err)
-		return err
+	return nil
+}
+
+// confirm publishes call messages in confirm mode and waits for broker ack,
+// cast messages are published without confirmation
+func (r *RPC) confirm(ctx context.Context, call bool, exchange, key string, msg Publishing) error {
+
+	// transport is set by Listen
+	if r.transport == nil {
+		return ERRNOTCONNECTED
 	}
 
-	r.channels.direct, err = r.conn.Channel()
-	if err != nil {
-		log.Println("Channel:", err)
-		return err
+	if !call {
+		return r.transport.Publish(ctx, exchange, key, msg)
 	}
 
-	err = r.channels.direct.Qos(r.limit, 0, false)
-	if err != nil {
-		log.Println("Channel:", err)
-		return err
+	cctx, cancel := context.WithTimeout(ctx, r.confirmTimeout)
+	defer cancel()
+
+	err := r.transport.PublishConfirm(cctx, exchange, key, msg)
+	if err == context.DeadlineExceeded && ctx.Err() == nil {
+		return ERRCONFIRMTIMEOUT
 	}
 
-	r.channels.topic, err = r.conn.Channel()
-	if err != nil {
-		log.Println("Channel:", err)
-		return err
+	return err
+}
+
+// respond sends handler result back to the reply queue set by request
+func (r *RPC) respond(m Delivery, s Sender, data []byte, e error) error {
+
+	if m.ReplyTo == "" {
+		return nil
 	}
 
-	err = r.channels.topic.Qos(r.limit, 0, false)
+	body, err := r.encode(Sender{r.name, r.uuid}, Destination{Name: s.Name, UUID: s.UUID}, Receiver{}, data)
 	if err != nil {
-		log.Println("Channel:", err)
 		return err
 	}
 
+	msg := Publishing{
+		ContentType:   m.ContentType,
+		CorrelationID: m.CorrelationID,
+		Body:          body,
+	}
+
+	if e != nil {
+		msg.Headers = map[string]interface{}{"error": e.Error()}
+	}
+	msg.Headers = r.signed(msg.Headers)
+
+	// reply is sent even when handler context is cancelled by shutdown
+	if err := r.transport.Publish(context.Background(), "", m.ReplyTo, msg); err != nil {
+		return fmt.Errorf("Reply Publish: %s", err)
+	}
+
+	return nil
+}
+
+func (r *RPC) subscribe() error {
+	var err error
+
+	// handlers of all consumers run in the same pool bounded by limit
+	pool := newDispatcher(r.limit)
+	defer pool.seal()
+
+	u := uuid.NewV4()
+
+	r.exchanges.direct = fmt.Sprintf("%s:%s", r.name, "direct")
+	r.exchanges.topic = fmt.Sprintf("%s:%s", r.name, "topic")
+	r.exchanges.deadLetter = fmt.Sprintf("%s:%s", r.name, "dead-letter")
+
+	// queue names are read by publishing and consuming routines while subscribe runs on reconnect
+	r.mutex.Lock()
+	r.pool = pool
+	r.queues.common = fmt.Sprintf("%s:%s", r.name, "direct")
+	r.queues.direct = fmt.Sprintf("%s:%s:%s", r.name, r.uuid, "direct")
+	r.queues.topic = fmt.Sprintf("%s:%s:%s", r.name, u.String(), "topic")
+	r.queues.deadLetter = fmt.Sprintf("%s:%s", r.name, "dead-letter")
+	r.mutex.Unlock()
+
+	// Get hostname for register current instance
+	r.logger.Debug("subscribe", Field{"name", r.name}, Field{"uuid", r.uuid})
+
 	// create direct exchange for guarantee delivery messages
-	if err = r.channels.direct.ExchangeDeclare(r.exchanges.direct, "direct", true, false, false, false, nil); err != nil {
+	if err = r.transport.ExchangeDeclare(r.exchanges.direct, "direct"); err != nil {
 		return fmt.Errorf("Exchange Declare: %s", err)
 	}
 
 	// create topic exchange for non guarantee delivery messages
-	if err = r.channels.topic.ExchangeDeclare(r.exchanges.topic, "topic", true, false, false, false, nil); err != nil {
+	if err = r.transport.ExchangeDeclare(r.exchanges.topic, "topic"); err != nil {
 		return fmt.Errorf("Exchange Declare: %s", err)
 	}
 
-
 	// create channel queue to route messages with round-robin
-	if _, err := r.channels.common.QueueDeclare(r.queues.common, true, false, false, false, nil); err != nil {
+	if _, err := r.transport.QueueDeclare(Queue{Name: r.queues.common, Durable: true, Args: r.queueArgs()}); err != nil {
 		return fmt.Errorf("Queue Declare: %s", err)
 	}
 
-	if err = r.channels.common.QueueBind(r.queues.common, strings.ToLower(r.name+":call"), r.exchanges.direct, false, nil); err != nil {
+	if err = r.transport.QueueBind(r.queues.common, strings.ToLower(r.name+":call"), r.exchanges.direct); err != nil {
 		return fmt.Errorf("Queue Bind: %s", err)
 	}
 
-	mc, err := r.channels.common.Consume(r.queues.common, r.queues.common, false, false, false, false, nil)
+	mc, err := r.transport.Consume(r.queues.common, r.queues.common, r.limit)
 	if err != nil {
 		return fmt.Errorf("Queue Consume: %s", err)
 	}
-	go r.handle(mc, done)
-
-
+	pool.consume(r.queues.common, func() { r.handle(mc, pool) })
 
 	// create topic queue for non guarantee delivery messages
-	if _, err := r.channels.topic.QueueDeclare(r.queues.topic, true, true, false, false, nil); err != nil {
+	if _, err := r.transport.QueueDeclare(Queue{Name: r.queues.topic, Durable: true, AutoDelete: true, Args: r.queueArgs()}); err != nil {
 		return fmt.Errorf("Queue Declare: %s", err)
 	}
 
-	if err = r.channels.topic.QueueBind(r.queues.topic, strings.ToLower(r.name + ":cast"), r.exchanges.direct, false, nil); err != nil {
+	if err = r.transport.QueueBind(r.queues.topic, strings.ToLower(r.name+":cast"), r.exchanges.direct); err != nil {
 		return fmt.Errorf("Queue Bind: %s", err)
 	}
 
-	if err = r.channels.topic.QueueBind(r.queues.topic, strings.ToLower(r.name + ":cast"), r.exchanges.topic, false, nil); err != nil {
+	if err = r.transport.QueueBind(r.queues.topic, strings.ToLower(r.name+":cast"), r.exchanges.topic); err != nil {
 		return fmt.Errorf("Queue Bind: %s", err)
 	}
 
-
-	mt, err := r.channels.topic.Consume(r.queues.topic, r.queues.topic, false, false, false, false, nil)
+	mt, err := r.transport.Consume(r.queues.topic, r.queues.topic, r.limit)
 	if err != nil {
 		return fmt.Errorf("Queue Consume: %s", err)
 	}
-	go r.handle(mt, done)
-
+	pool.consume(r.queues.topic, func() { r.handle(mt, pool) })
 
 	// = end topic declaration
 
+	// create dead-letter queue for messages failed by handlers with retry policy
+	if err = r.transport.ExchangeDeclare(r.exchanges.deadLetter, "direct"); err != nil {
+		return fmt.Errorf("Exchange Declare: %s", err)
+	}
+
+	if _, err := r.transport.QueueDeclare(Queue{Name: r.queues.deadLetter, Durable: true}); err != nil {
+		return fmt.Errorf("Queue Declare: %s", err)
+	}
+
+	if err = r.transport.QueueBind(r.queues.deadLetter, strings.ToLower(r.name), r.exchanges.deadLetter); err != nil {
+		return fmt.Errorf("Queue Bind: %s", err)
+	}
+
+	// create exclusive queue to receive responses for requests
+	reply, err := r.transport.QueueDeclare(Queue{AutoDelete: true, Exclusive: true})
+	if err != nil {
+		return fmt.Errorf("Queue Declare: %s", err)
+	}
+
+	r.mutex.Lock()
+	r.queues.reply = reply
+	r.mutex.Unlock()
+
+	mr, err := r.transport.Consume(reply, reply, r.limit)
+	if err != nil {
+		return fmt.Errorf("Queue Consume: %s", err)
+	}
+	pool.watch(reply, func() { r.replied(mr) })
+
+	if r.presence.announcing() > 0 {
+		if err = r.subscribePresence(pool); err != nil {
+			return err
+		}
+	}
+
 	if r.uuid == "" {
 		return nil
 	}
 
-	if err = r.channels.topic.QueueBind(r.queues.topic, strings.ToLower(r.uuid + ":cast"), r.exchanges.direct, false, nil); err != nil {
+	if err = r.transport.QueueBind(r.queues.topic, strings.ToLower(r.uuid+":cast"), r.exchanges.direct); err != nil {
 		return fmt.Errorf("Queue Bind: %s", err)
 	}
 
 	// create direct queue for guarantee delivery messages
-	if _, err := r.channels.direct.QueueDeclare(r.queues.direct, true, false, false, false, nil); err != nil {
+	if _, err := r.transport.QueueDeclare(Queue{Name: r.queues.direct, Durable: true, Args: r.queueArgs()}); err != nil {
 		return fmt.Errorf("Queue Declare: %s", err)
 	}
 
 	// create bindings for direct messages
-	if err = r.channels.direct.QueueBind(r.queues.direct, strings.ToLower(r.uuid + ":call"), r.exchanges.direct, false, nil); err != nil {
+	if err = r.transport.QueueBind(r.queues.direct, strings.ToLower(r.uuid+":call"), r.exchanges.direct); err != nil {
 		return fmt.Errorf("Queue Bind: %s", err)
 	}
 
-	md, err := r.channels.direct.Consume(r.queues.direct, r.queues.direct, false, false, false, false, nil)
+	md, err := r.transport.Consume(r.queues.direct, r.queues.direct, r.limit)
 	if err != nil {
 		return fmt.Errorf("Queue Consume: %s", err)
 	}
-	go r.handle(md, done)
+	pool.consume(r.queues.direct, func() { r.handle(md, pool) })
 
+	return nil
+}
 
+// queueNames returns names of queues declared by the last subscribe
+func (r *RPC) queueNames() queues {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
 
-	return nil
+	return r.queues
 }
 
-func (r *RPC) handle(msgs <-chan amqp.Delivery, done chan error) {
+// handle decodes deliveries and passes them to dispatcher workers
+func (r *RPC) handle(msgs <-chan Delivery, pool *dispatcher) {
 
-	concurrent := 0
-	last := make(chan bool)
+	// consumer is started after queues are named, deliveries carry names of its subscribe
+	topic := r.queueNames().topic
 
 	for d := range msgs {
 
-		log.Println("RPC: message from:", d.DeliveryTag, d.ConsumerTag, string(d.Body))
+		s, e, p, data, err := r.decode(d.Body, d.Headers)
+		if err != nil {
+			r.metrics.decodeFailed(err)
+		}
+
+		if _, ok := err.(*SignatureError); ok {
+			r.logger.Warn("message rejected", fieldDelivery(d), fieldErr(err))
+			d.Ack()
+			continue
+		}
 
-		s, e, p, data, err := r.decode(d.Body)
 		if err != nil {
-			log.Println("RPC: message parsing failed: ", err)
-			d.Ack(false)
+			r.logger.Warn("message decode failed", fieldDelivery(d), fieldErr(err))
+			d.Ack()
 			continue
 		}
 
-		go func() {
-			if p.Name == "" {
-				return
+		if expired(d, time.Now()) {
+			handler := e.Handler
+			if p.Name != "" {
+				handler = p.Handler
 			}
-			log.Println("PRC: need upstream", d.ConsumerTag)
-			_, ok := r.upstreams[p.Handler]
+			r.expire(d, s, e, handler, data)
+			continue
+		}
 
-			if !ok {
-				log.Println("RPC: upstream not found", p.Handler)
-				d.Ack(false)
-				return
-			}
+		m := &Message{
+			Sender:      s,
+			Destination: e,
+			Receiver:    p,
+			ContentType: d.ContentType,
+			Body:        data,
+			Call:        d.ConsumerTag != topic,
+		}
 
-			concurrent++
-			err := r.upstreams[p.Handler](s, e, data)
-			if err != nil {
-				log.Println("RPC: Proxy error:", err)
-			}
+		pool.submit(d, func(d Delivery) {
+			r.process(d, m)
+		})
+	}
 
-			d.Ack(false)
-			concurrent--
-			if concurrent == 0 {
-				last <- true
-			}
+	r.logger.Debug("deliveries channel closed", Field{"name", r.name})
+}
 
-		}()
+// process runs upstream for proxied message or handler otherwise and settles delivery
+func (r *RPC) process(d Delivery, m *Message) {
 
-		go func() {
+	s, e, p := m.Sender, m.Destination, m.Receiver
 
-			if p.Name != "" {
-				return
-			}
+	kind, name, routes, missing := "handler", e.Handler, r.handlers, ERRHANDLERNOTFOUND
+	if p.Name != "" {
+		kind, name, routes, missing = "upstream", p.Handler, r.upstreams, ERRUPSTREAMNOTFOUND
+	}
 
-			log.Println("PRC: send to handler", d.ConsumerTag)
-			_, ok := r.handlers[e.Handler]
-			if !ok {
-				log.Println("RPC: handler not found", e.Handler)
-				d.Ack(false)
-				return
-			}
+	r.logger.Debug("message received", append([]Field{
+		fieldSender(s), fieldDestination(e), fieldHandler(name), fieldDelivery(d),
+	}, r.payload(m.Body)...)...)
 
-			concurrent++
-			err := r.handlers[e.Handler](s, data)
-			if err != nil {
-				log.Println("RPC: Proxy error:", err)
-			}
+	rt, ok := routes[name]
+	if !ok {
+		r.logger.Warn(kind+" not found", fieldSender(s), fieldHandler(name), fieldDelivery(d))
+		r.respond(d, s, nil, missing)
+		d.Ack()
+		return
+	}
 
-			d.Ack(false)
-			concurrent--
-			if concurrent == 0 {
-				last <- true
+	ctx, cancel := r.context(d)
+	defer cancel()
+
+	// streaming handler result is the end of stream frame instead of reply
+	reply := func(out []byte, err error) {
+		r.respond(d, s, out, err)
+	}
+	if rt.stream {
+		st := r.newStream(d, s)
+		ctx = context.WithValue(ctx, streamKey, st)
+		reply = func(_ []byte, err error) {
+			if st.reply != "" {
+				st.end(err)
 			}
+		}
+	}
 
-		}()
+	ctx, end := r.extract(ctx, name, m, d)
+
+	done := r.metrics.handle(name)
+	out, err := r.invoke(ctx, rt, m)
+	done(err)
+	end(err)
+	if err != nil {
+		r.logger.Error(kind+" failed", fieldSender(s), fieldDestination(e), fieldHandler(name), fieldDelivery(d), fieldErr(err))
 	}
 
-	if concurrent > 0 {
+	r.settle(d, s, name, out, err, reply)
+}
+
+// context returns per-delivery context for handler, it is cancelled on shutdown,
+// expires with the deadline set by caller and carries message priority
+func (r *RPC) context(d Delivery) (context.Context, context.CancelFunc) {
+	ctx := context.WithValue(r.ctx, contentTypeKey, d.ContentType)
+	ctx = context.WithValue(ctx, priorityKey, d.Priority)
+	if deadline, ok := d.Headers["deadline"].(int64); ok {
+		return context.WithDeadline(ctx, time.Unix(0, deadline))
+	}
+	return context.WithCancel(ctx)
+}
+
+// replied passes responses from reply queue to waiting requests
+func (r *RPC) replied(msgs <-chan Delivery) {
+
+	for d := range msgs {
+
+		d.Ack()
+
+		s, _, _, data, err := r.decode(d.Body, d.Headers)
+		if err != nil {
+			r.metrics.decodeFailed(err)
+			r.logger.Warn("reply decode failed", fieldDelivery(d), fieldErr(err))
+			continue
+		}
+
+		r.mutex.Lock()
+		w, ok := r.pending[d.CorrelationID]
+		stream, streaming := r.streams[d.CorrelationID]
+		r.mutex.Unlock()
+
+		if streaming {
+			stream.push(d, data)
+			continue
+		}
+
+		if !ok {
+			r.logger.Debug("reply without request", Field{"correlation_id", d.CorrelationID})
+			continue
+		}
+
+		rp := reply{sender: s, contentType: d.ContentType, data: data}
+		if e, ok := d.Headers["error"].(string); ok {
+			rp.err = errors.New(e)
+		}
+
+		// reply waits until caller takes it, broadcast caller collects replies until its ctx is done
 		select {
-		case <-last:
-			break
+		case w.replies <- rp:
+		case <-w.done:
+			r.logger.Debug("reply after caller stopped waiting", fieldSender(s), Field{"correlation_id", d.CorrelationID})
 		}
 	}
+}
+
+// returned passes unroutable cast messages to return handler,
+// returned call messages are reported to caller by ERRNOROUTE
+func (r *RPC) returned(returns <-chan Return) {
+
+	for m := range returns {
 
-	fmt.Println("handle: deliveries channel closed")
-	r.done <- nil
-	return
+		_, d, _, data, err := r.decode(m.Body, m.Headers)
+		if err != nil {
+			r.logger.Warn("returned message decode failed", fieldErr(err))
+			continue
+		}
+
+		r.logger.Warn("message returned", fieldDestination(d), fieldHandler(d.Handler), Field{"reason", m.Reason})
+
+		r.mutex.Lock()
+		h := r.returnHandler
+		r.mutex.Unlock()
+
+		if h != nil {
+			h(d, data)
+		}
+	}
 }
 
 func (r *RPC) cleanup() error {
 	var err error
-	err = r.channels.direct.ExchangeDelete(r.exchanges.direct, false, true)
+
+	if r.transport == nil {
+		return nil
+	}
+
+	err = r.transport.ExchangeDelete(r.exchanges.direct)
 	if err != nil {
-		log.Println("Exchange remove error", err)
+		r.logger.Error("exchange remove failed", Field{"exchange", r.exchanges.direct}, fieldErr(err))
 		return err
 	}
 
-	_, err = r.channels.direct.QueueDelete(r.queues.direct, false, false, true)
+	direct := r.queueNames().direct
+
+	err = r.transport.QueueDelete(direct)
 	if err != nil {
-		log.Println("Queue remove error", err)
+		r.logger.Error("queue remove failed", Field{"queue", direct}, fieldErr(err))
 		return err
 	}
 
-	err = r.channels.topic.ExchangeDelete(r.exchanges.topic, false, true)
+	err = r.transport.ExchangeDelete(r.exchanges.topic)
 	if err != nil {
-		log.Println("Exchange remove error", err)
+		r.logger.Error("exchange remove failed", Field{"exchange", r.exchanges.topic}, fieldErr(err))
 		return err
 	}
 
@@ -383,24 +755,71 @@ func (r *RPC) cleanup() error {
 }
 
 func (r *RPC) shutdown() error {
-	// will close() the deliveries channel
-	log.Println("RPC: Shutdown broker")
-	// close direct channels
-	if err := r.channels.direct.Cancel(r.queues.direct, false); err != nil {
-		return fmt.Errorf("Consumer cancel failed: %s", err)
+	return r.stop(context.Background())
+}
+
+// stop stops consumers, waits for running handlers until ctx is done,
+// requeues deliveries of unfinished handlers and closes transport
+func (r *RPC) stop(ctx context.Context) error {
+	r.logger.Info("shutdown", Field{"name", r.name})
+
+	// handler contexts are cancelled once drain is over
+	defer r.cancel()
+
+	// transport of broker never reached has nothing to cancel and close
+	if r.transport == nil || !r.status.wasConnected() {
+		return nil
+	}
+
+	queues := r.queueNames()
+
+	// peers stop choosing instance before it stops consuming
+	if queues.presence != "" && r.status.ready() {
+		if err := r.announce(true); err != nil {
+			r.logger.Warn("leave heartbeat failed", Field{"name", r.name}, fieldErr(err))
+		}
+	}
+
+	// cancelled consumers close deliveries channels
+	for _, q := range []string{queues.common, queues.direct, queues.topic} {
+		if err := r.transport.Cancel(q); err != nil {
+			return fmt.Errorf("Consumer cancel failed: %s", err)
+		}
 	}
 
-	if err := r.channels.topic.Cancel(r.queues.topic, false); err != nil {
+	r.mutex.Lock()
+	pool := r.pool
+	r.mutex.Unlock()
+
+	var err error
+
+	if pool != nil {
+		select {
+		case <-pool.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+			n := pool.abandon()
+			r.logger.Warn("shutdown deadline exceeded, deliveries requeued", Field{"name", r.name}, Field{"requeued", n})
+		}
+	}
+
+	// reply queue is consumed until handlers finished, they may wait for replies
+	if err := r.transport.Cancel(queues.reply); err != nil {
 		return fmt.Errorf("Consumer cancel failed: %s", err)
 	}
-	<-r.done
-	if err := r.conn.Close(); err != nil {
-		return fmt.Errorf("AMQP connection close error: %s", err)
+
+	if queues.presence != "" {
+		if err := r.transport.Cancel(queues.presence); err != nil {
+			return fmt.Errorf("Consumer cancel failed: %s", err)
+		}
 	}
 
-	defer fmt.Printf("AMQP shutdown OK")
+	if err := r.transport.Close(); err != nil {
+		return fmt.Errorf("Transport connection close error: %s", err)
+	}
+	r.status.disconnect(nil)
 
-	return nil
-	// wait for handle() to exit
+	r.logger.Debug("transport closed", Field{"name", r.name})
 
+	return err
 }
@@ -1,20 +1,25 @@
 package rpc
 
 import (
-	"encoding/json"
-	"log"
+	"context"
 )
 
 // Call - send message with delivery guarantee
 func (r *RPC) Call(d Destination, message interface{}) error {
+	return r.CallContext(context.Background(), d, message)
+}
+
+// CallContext - send message with delivery guarantee,
+// ctx bounds publishing and its deadline is passed to receiver handler
+func (r *RPC) CallContext(ctx context.Context, d Destination, message interface{}) error {
 
-	msg, err := json.Marshal(message)
+	msg, err := r.codec.Marshal(message)
 	if err != nil {
-		log.Println("RPC: Protocol encode error")
+		r.logger.Error("message encode failed", fieldDestination(d), fieldHandler(d.Handler), fieldErr(err))
 		return err
 	}
 
-	err = r.call(Sender{r.name, r.uuid}, d, Receiver{}, msg)
+	err = r.call(ctx, Sender{r.name, r.uuid}, d, Receiver{}, r.codec.ContentType(), msg)
 	if err != nil {
 		return err
 	}
@@ -24,14 +29,20 @@ func (r *RPC) Call(d Destination, message interface{}) error {
 
 // Cast - send message without delivery guarantee
 func (r *RPC) Cast(d Destination, message interface{}) error {
+	return r.CastContext(context.Background(), d, message)
+}
 
-	msg, err := json.Marshal(message)
+// CastContext - send message without delivery guarantee,
+// ctx bounds publishing and its deadline is passed to receiver handler
+func (r *RPC) CastContext(ctx context.Context, d Destination, message interface{}) error {
+
+	msg, err := r.codec.Marshal(message)
 	if err != nil {
-		log.Println("RPC: Protocol encode error")
+		r.logger.Error("message encode failed", fieldDestination(d), fieldHandler(d.Handler), fieldErr(err))
 		return err
 	}
 
-	err = r.cast(Sender{r.name, r.uuid}, d, Receiver{}, msg)
+	err = r.cast(ctx, Sender{r.name, r.uuid}, d, Receiver{}, r.codec.ContentType(), msg)
 	if err != nil {
 		return err
 	}
@@ -41,8 +52,14 @@ func (r *RPC) Cast(d Destination, message interface{}) error {
 
 // CallBinary - send binary message with delivery guarantee
 func (r *RPC) CallBinary(d Destination, message []byte) error {
+	return r.CallBinaryContext(context.Background(), d, message)
+}
 
-	err := r.call(Sender{r.name, r.uuid}, d, Receiver{}, message)
+// CallBinaryContext - send binary message with delivery guarantee,
+// ctx bounds publishing and its deadline is passed to receiver handler
+func (r *RPC) CallBinaryContext(ctx context.Context, d Destination, message []byte) error {
+
+	err := r.call(ctx, Sender{r.name, r.uuid}, d, Receiver{}, ContentTypeBinary, message)
 	if err != nil {
 		return err
 	}
@@ -52,7 +69,14 @@ func (r *RPC) CallBinary(d Destination, message []byte) error {
 
 // CastBinary - send binary message without delivery guarantee
 func (r *RPC) CastBinary(d Destination, message []byte) error {
-	err := r.cast(Sender{r.name, r.uuid}, d, Receiver{}, message)
+	return r.CastBinaryContext(context.Background(), d, message)
+}
+
+// CastBinaryContext - send binary message without delivery guarantee,
+// ctx bounds publishing and its deadline is passed to receiver handler
+func (r *RPC) CastBinaryContext(ctx context.Context, d Destination, message []byte) error {
+
+	err := r.cast(ctx, Sender{r.name, r.uuid}, d, Receiver{}, ContentTypeBinary, message)
 	if err != nil {
 		return err
 	}
@@ -62,14 +86,20 @@ func (r *RPC) CastBinary(d Destination, message []byte) error {
 
 // CallSigned - send signed message with delivery guarantee
 func (r *RPC) CallSigned(s Sender, d Destination, message interface{}) error {
+	return r.CallSignedContext(context.Background(), s, d, message)
+}
+
+// CallSignedContext - send signed message with delivery guarantee,
+// ctx bounds publishing and its deadline is passed to receiver handler
+func (r *RPC) CallSignedContext(ctx context.Context, s Sender, d Destination, message interface{}) error {
 
-	msg, err := json.Marshal(message)
+	msg, err := r.codec.Marshal(message)
 	if err != nil {
-		log.Println("RPC: Protocol encode error")
+		r.logger.Error("message encode failed", fieldDestination(d), fieldHandler(d.Handler), fieldErr(err))
 		return err
 	}
 
-	err = r.call(s, d, Receiver{}, msg)
+	err = r.call(ctx, s, d, Receiver{}, r.codec.ContentType(), msg)
 	if err != nil {
 		return err
 	}
@@ -79,14 +109,20 @@ func (r *RPC) CallSigned(s Sender, d Destination, message interface{}) error {
 
 // CastSigned - send signed message without delivery guarantee
 func (r *RPC) CastSigned(s Sender, d Destination, message interface{}) error {
+	return r.CastSignedContext(context.Background(), s, d, message)
+}
 
-	msg, err := json.Marshal(message)
+// CastSignedContext - send signed message without delivery guarantee,
+// ctx bounds publishing and its deadline is passed to receiver handler
+func (r *RPC) CastSignedContext(ctx context.Context, s Sender, d Destination, message interface{}) error {
+
+	msg, err := r.codec.Marshal(message)
 	if err != nil {
-		log.Println("RPC: Protocol encode error")
+		r.logger.Error("message encode failed", fieldDestination(d), fieldHandler(d.Handler), fieldErr(err))
 		return err
 	}
 
-	err = r.cast(s, d, Receiver{}, msg)
+	err = r.cast(ctx, s, d, Receiver{}, r.codec.ContentType(), msg)
 	if err != nil {
 		return err
 	}
@@ -96,8 +132,14 @@ func (r *RPC) CastSigned(s Sender, d Destination, message interface{}) error {
 
 // CallSignedBinary - send signed binary message with delivery guarantee
 func (r *RPC) CallSignedBinary(s Sender, d Destination, message []byte) error {
+	return r.CallSignedBinaryContext(context.Background(), s, d, message)
+}
 
-	err := r.call(s, d, Receiver{}, message)
+// CallSignedBinaryContext - send signed binary message with delivery guarantee,
+// ctx bounds publishing and its deadline is passed to receiver handler
+func (r *RPC) CallSignedBinaryContext(ctx context.Context, s Sender, d Destination, message []byte) error {
+
+	err := r.call(ctx, s, d, Receiver{}, ContentTypeBinary, message)
 	if err != nil {
 		return err
 	}
@@ -107,8 +149,14 @@ func (r *RPC) CallSignedBinary(s Sender, d Destination, message []byte) error {
 
 // CastSignedBinary - send signed binary message without delivery guarantee
 func (r *RPC) CastSignedBinary(s Sender, d Destination, message []byte) error {
+	return r.CastSignedBinaryContext(context.Background(), s, d, message)
+}
 
-	err := r.cast(s, d, Receiver{}, message)
+// CastSignedBinaryContext - send signed binary message without delivery guarantee,
+// ctx bounds publishing and its deadline is passed to receiver handler
+func (r *RPC) CastSignedBinaryContext(ctx context.Context, s Sender, d Destination, message []byte) error {
+
+	err := r.cast(ctx, s, d, Receiver{}, ContentTypeBinary, message)
 	if err != nil {
 		return err
 	}
@@ -116,17 +164,90 @@ func (r *RPC) CastSignedBinary(s Sender, d Destination, message []byte) error {
 	return nil
 }
 
+// Request - send message with delivery guarantee and wait for handler response,
+// response data is decoded into out with codec matching response content type
+func (r *RPC) Request(ctx context.Context, d Destination, in interface{}, out interface{}) error {
+
+	msg, err := r.codec.Marshal(in)
+	if err != nil {
+		r.logger.Error("message encode failed", fieldDestination(d), fieldHandler(d.Handler), fieldErr(err))
+		return err
+	}
+
+	rp, err := r.request(ctx, Sender{r.name, r.uuid}, d, Receiver{}, r.codec.ContentType(), msg)
+	if err != nil {
+		return err
+	}
+
+	if out == nil || len(rp.data) == 0 {
+		return nil
+	}
+
+	c, err := r.codecFor(rp.contentType)
+	if err != nil {
+		return err
+	}
+
+	return c.Unmarshal(rp.data, out)
+}
+
+// RequestBinary - send binary message with delivery guarantee and wait for handler response
+func (r *RPC) RequestBinary(ctx context.Context, d Destination, message []byte) ([]byte, error) {
+	rp, err := r.request(ctx, Sender{r.name, r.uuid}, d, Receiver{}, ContentTypeBinary, message)
+	if err != nil {
+		return nil, err
+	}
+	return rp.data, nil
+}
+
+// Broadcast - send message to all instances of application and collect their handler
+// responses by instance uuid until expected number of instances replied or ctx is done.
+// When expected is not positive replies are collected until ctx is done, len of Peers
+// is the expected number when presence is enabled. ctx error is returned with replies
+// collected so far when expected number of replies is not received in time
+func (r *RPC) Broadcast(ctx context.Context, d Destination, message interface{}, expected int) (map[string]Reply, error) {
+
+	msg, err := r.codec.Marshal(message)
+	if err != nil {
+		r.logger.Error("message encode failed", fieldDestination(d), fieldHandler(d.Handler), fieldErr(err))
+		return nil, err
+	}
+
+	return r.gather(ctx, Sender{r.name, r.uuid}, d, r.codec.ContentType(), msg, expected)
+}
+
+// BroadcastBinary - send binary message to all instances of application and collect
+// their handler responses by instance uuid like Broadcast
+func (r *RPC) BroadcastBinary(ctx context.Context, d Destination, message []byte, expected int) (map[string]Reply, error) {
+	return r.gather(ctx, Sender{r.name, r.uuid}, d, ContentTypeBinary, message, expected)
+}
+
+// DecodeReply - decode broadcast reply data with codec matching reply content type
+func (r *RPC) DecodeReply(rp Reply, v interface{}) error {
+	c, err := r.codecFor(rp.ContentType)
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(rp.Data, v)
+}
+
 // Proxy send message methods
 // ProxyCall - send message throw another application with delivery guarantee
 func (r *RPC) ProxyCall(d Destination, p Receiver, message interface{}) error {
+	return r.ProxyCallContext(context.Background(), d, p, message)
+}
 
-	msg, err := json.Marshal(message)
+// ProxyCallContext - send message throw another application with delivery guarantee,
+// ctx bounds publishing and its deadline is passed to receiver handler
+func (r *RPC) ProxyCallContext(ctx context.Context, d Destination, p Receiver, message interface{}) error {
+
+	msg, err := r.codec.Marshal(message)
 	if err != nil {
-		log.Println("RPC: Protocol encode error")
+		r.logger.Error("message encode failed", fieldDestination(d), fieldHandler(d.Handler), fieldErr(err))
 		return err
 	}
 
-	err = r.call(Sender{r.name, r.uuid}, d, p, msg)
+	err = r.call(ctx, Sender{r.name, r.uuid}, d, p, r.codec.ContentType(), msg)
 	if err != nil {
 		return err
 	}
@@ -136,14 +257,20 @@ func (r *RPC) ProxyCall(d Destination, p Receiver, message interface{}) error {
 
 // ProxyCast - send message throw another application without delivery guarantee
 func (r *RPC) ProxyCast(d Destination, p Receiver, message interface{}) error {
+	return r.ProxyCastContext(context.Background(), d, p, message)
+}
 
-	msg, err := json.Marshal(message)
+// ProxyCastContext - send message throw another application without delivery guarantee,
+// ctx bounds publishing and its deadline is passed to receiver handler
+func (r *RPC) ProxyCastContext(ctx context.Context, d Destination, p Receiver, message interface{}) error {
+
+	msg, err := r.codec.Marshal(message)
 	if err != nil {
-		log.Println("RPC: Protocol encode error")
+		r.logger.Error("message encode failed", fieldDestination(d), fieldHandler(d.Handler), fieldErr(err))
 		return err
 	}
 
-	err = r.cast(Sender{r.name, r.uuid}, d, p, msg)
+	err = r.cast(ctx, Sender{r.name, r.uuid}, d, p, r.codec.ContentType(), msg)
 	if err != nil {
 		return err
 	}
@@ -153,8 +280,14 @@ func (r *RPC) ProxyCast(d Destination, p Receiver, message interface{}) error {
 
 // ProxyCallBinary - send binary message throw another application with delivery guarantee
 func (r *RPC) ProxyCallBinary(d Destination, p Receiver, message []byte) error {
+	return r.ProxyCallBinaryContext(context.Background(), d, p, message)
+}
+
+// ProxyCallBinaryContext - send binary message throw another application with delivery guarantee,
+// ctx bounds publishing and its deadline is passed to receiver handler
+func (r *RPC) ProxyCallBinaryContext(ctx context.Context, d Destination, p Receiver, message []byte) error {
 
-	err := r.call(Sender{r.name, r.uuid}, d, p, message)
+	err := r.call(ctx, Sender{r.name, r.uuid}, d, p, ContentTypeBinary, message)
 	if err != nil {
 		return err
 	}
@@ -164,8 +297,14 @@ func (r *RPC) ProxyCallBinary(d Destination, p Receiver, message []byte) error {
 
 // ProxyCastBinary - send message throw another application without delivery guarantee
 func (r *RPC) ProxyCastBinary(d Destination, p Receiver, message []byte) error {
+	return r.ProxyCastBinaryContext(context.Background(), d, p, message)
+}
+
+// ProxyCastBinaryContext - send message throw another application without delivery guarantee,
+// ctx bounds publishing and its deadline is passed to receiver handler
+func (r *RPC) ProxyCastBinaryContext(ctx context.Context, d Destination, p Receiver, message []byte) error {
 
-	err := r.cast(Sender{r.name, r.uuid}, d, p, message)
+	err := r.cast(ctx, Sender{r.name, r.uuid}, d, p, ContentTypeBinary, message)
 	if err != nil {
 		return err
 	}
@@ -173,12 +312,59 @@ func (r *RPC) ProxyCastBinary(d Destination, p Receiver, message []byte) error {
 	return nil
 }
 
-// SetHeader - set handler routing
-func (r *RPC) SetHandler(h string, f Handler) {
-	r.handlers[h] = f
+// SetHandler - set handler routing, interceptors wrap only this handler
+func (r *RPC) SetHandler(h string, f Handler, i ...Interceptor) {
+	r.SetHandlerContext(h, func(_ context.Context, s Sender, data []byte) error {
+		return f(s, data)
+	}, i...)
+}
+
+// SetHandlerContext - set handler routing, handler receives per-delivery context
+func (r *RPC) SetHandlerContext(h string, f HandlerContext, i ...Interceptor) {
+	r.SetReplyHandlerContext(h, func(ctx context.Context, s Sender, data []byte) ([]byte, error) {
+		return nil, f(ctx, s, data)
+	}, i...)
+}
+
+// SetReplyHandler - set handler routing, handler result is sent back to requester
+func (r *RPC) SetReplyHandler(h string, f ReplyHandler, i ...Interceptor) {
+	r.SetReplyHandlerContext(h, func(_ context.Context, s Sender, data []byte) ([]byte, error) {
+		return f(s, data)
+	}, i...)
+}
+
+// SetReplyHandlerContext - set handler routing, handler receives per-delivery context
+// and its result is sent back to requester
+func (r *RPC) SetReplyHandlerContext(h string, f ReplyHandlerContext, i ...Interceptor) {
+	r.handlers[h] = route{
+		invoke: func(ctx context.Context, m *Message) ([]byte, error) {
+			return f(ctx, m.Sender, m.Body)
+		},
+		interceptors: i,
+	}
+}
+
+// SetUpstream - set upstream routing, interceptors wrap only this upstream
+func (r *RPC) SetUpstream(u string, f Upstream, i ...Interceptor) {
+	r.SetUpstreamContext(u, func(_ context.Context, s Sender, d Destination, data []byte) error {
+		return f(s, d, data)
+	}, i...)
+}
+
+// SetUpstreamContext - set upstream routing, upstream receives per-delivery context
+func (r *RPC) SetUpstreamContext(u string, f UpstreamContext, i ...Interceptor) {
+	r.upstreams[u] = route{
+		invoke: func(ctx context.Context, m *Message) ([]byte, error) {
+			return nil, f(ctx, m.Sender, m.Destination, m.Body)
+		},
+		interceptors: i,
+	}
 }
 
-// SetUpstream - set upstream routing
-func (r *RPC) SetUpstream(u string, f Upstream) {
-	r.upstreams[u] = f
+// SetReturnHandler - set handler receiving cast messages which broker could not route
+// to any queue, unroutable call messages are returned to caller as ERRNOROUTE
+func (r *RPC) SetReturnHandler(f ReturnHandler) {
+	r.mutex.Lock()
+	r.returnHandler = f
+	r.mutex.Unlock()
 }
@@ -0,0 +1,155 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v5"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeGob      = "application/x-gob"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeMsgpack  = "application/x-msgpack"
+	ContentTypeBinary   = "application/octet-stream"
+)
+
+// Codec - encodes messages sent by Call, Cast and other non binary methods,
+// message content type travels with message and selects codec on receiving side
+type Codec interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// JSONCodec - encode messages with encoding/json
+type JSONCodec struct{}
+
+// GobCodec - encode messages with encoding/gob
+type GobCodec struct{}
+
+// ProtobufCodec - encode messages implementing proto.Message
+type ProtobufCodec struct{}
+
+// MsgpackCodec - encode messages with msgpack
+type MsgpackCodec struct{}
+
+// BinaryCodec - pass []byte messages as is
+type BinaryCodec struct{}
+
+type contextKey int
+
+const (
+	contentTypeKey contextKey = iota
+	streamKey
+	priorityKey
+	expirationKey
+	scheduleKey
+)
+
+func (JSONCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (JSONCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (GobCodec) ContentType() string {
+	return ContentTypeGob
+}
+
+func (GobCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Unmarshal(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+func (ProtobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (ProtobufCodec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("Protobuf codec: %T does not implement proto.Message", v)
+	}
+	return proto.Marshal(m)
+}
+
+func (ProtobufCodec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("Protobuf codec: %T does not implement proto.Message", v)
+	}
+	return proto.Unmarshal(data, m)
+}
+
+func (MsgpackCodec) ContentType() string {
+	return ContentTypeMsgpack
+}
+
+func (MsgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (MsgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+func (BinaryCodec) ContentType() string {
+	return ContentTypeBinary
+}
+
+func (BinaryCodec) Marshal(v interface{}) ([]byte, error) {
+	data, ok := v.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("Binary codec: %T is not []byte", v)
+	}
+	return data, nil
+}
+
+func (BinaryCodec) Unmarshal(data []byte, v interface{}) error {
+	b, ok := v.(*[]byte)
+	if !ok {
+		return fmt.Errorf("Binary codec: %T is not *[]byte", v)
+	}
+	*b = append((*b)[:0], data...)
+	return nil
+}
+
+// ContentType - returns content type of message handled with ctx
+func ContentType(ctx context.Context) string {
+	ct, _ := ctx.Value(contentTypeKey).(string)
+	return ct
+}
+
+// codecFor returns codec registered for content type
+func (r *RPC) codecFor(contentType string) (Codec, error) {
+
+	if contentType == "" {
+		return r.codec, nil
+	}
+
+	c, ok := r.codecs[contentType]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ERRUNKNOWNCODEC, contentType)
+	}
+
+	return c, nil
+}
@@ -0,0 +1,99 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type codecMessage struct {
+	Name  string
+	Count int
+}
+
+func TestCodecMarshal(t *testing.T) {
+
+	m := codecMessage{Name: "name", Count: 2}
+
+	for _, c := range []Codec{JSONCodec{}, GobCodec{}, MsgpackCodec{}} {
+
+		data, err := c.Marshal(m)
+		if err != nil {
+			t.Errorf("%s: marshal failed: %s", c.ContentType(), err)
+			continue
+		}
+
+		i := codecMessage{}
+		if err := c.Unmarshal(data, &i); err != nil {
+			t.Errorf("%s: unmarshal failed: %s", c.ContentType(), err)
+			continue
+		}
+
+		if i != m {
+			t.Errorf("%s: expected %v got %v", c.ContentType(), m, i)
+		}
+	}
+}
+
+func TestCodecProtobuf(t *testing.T) {
+
+	c := ProtobufCodec{}
+
+	data, err := c.Marshal(wrapperspb.String("name"))
+	if err != nil {
+		t.Fatal("Marshal failed:", err)
+	}
+
+	m := &wrapperspb.StringValue{}
+	if err := c.Unmarshal(data, m); err != nil {
+		t.Fatal("Unmarshal failed:", err)
+	}
+
+	if m.GetValue() != "name" {
+		t.Errorf("Expected %s got %s", "name", m.GetValue())
+	}
+
+	if _, err := c.Marshal(codecMessage{}); err == nil {
+		t.Error("Expected error for non proto message")
+	}
+}
+
+func TestCodecRequest(t *testing.T) {
+
+	b := NewMemoryBroker()
+
+	r, _ := Register("test-codec-request", "uuid", "token")
+	r.SetCodec(MsgpackCodec{})
+
+	r.SetReplyHandlerContext("handler", func(ctx context.Context, s Sender, p []byte) ([]byte, error) {
+
+		if ContentType(ctx) != ContentTypeMsgpack {
+			t.Errorf("Expected content type: %s got %s", ContentTypeMsgpack, ContentType(ctx))
+		}
+
+		i := codecMessage{}
+		if err := r.Decode(ctx, p, &i); err != nil {
+			return nil, err
+		}
+
+		i.Count++
+		return r.Encode(ctx, i)
+	})
+	listenMemory(t, b, r)
+	defer r.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	out := codecMessage{}
+	d := Destination{Name: "test-codec-request", Handler: "handler"}
+	if err := r.Request(ctx, d, codecMessage{"name", 1}, &out); err != nil {
+		t.Fatal("Request failed:", err)
+	}
+
+	if out.Name != "name" || out.Count != 2 {
+		t.Errorf("Received response validation failed: %v", out)
+	}
+}
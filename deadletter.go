@@ -0,0 +1,261 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// message headers set on retried and dead-lettered messages
+const (
+	headerAttempt           = "x-retry-attempt"
+	headerDeadLetterID      = "x-dead-letter-id"
+	headerDeadLetterReason  = "x-dead-letter-reason"
+	headerDeadLetterHandler = "x-dead-letter-handler"
+	headerDeadLetterQueue   = "x-dead-letter-queue"
+	headerDeadLetterTime    = "x-dead-letter-time"
+)
+
+// RetryPolicy - failed handler message is delivered again after Delay
+// up to Attempts times and then moved to the application dead-letter queue
+type RetryPolicy struct {
+	Attempts int
+	Delay    time.Duration
+}
+
+// DeadLetter - message moved to dead-letter queue when handler retries are exhausted
+type DeadLetter struct {
+	ID          string
+	Sender      Sender
+	Destination Destination
+	Receiver    Receiver
+	Handler     string
+	Queue       string
+	Reason      string
+	Attempts    int
+	Time        time.Time
+	ContentType string
+	Body        []byte
+}
+
+// SetRetryPolicy - set retry policy for handler or upstream, messages failed by
+// handlers without policy are acknowledged and dropped
+func (r *RPC) SetRetryPolicy(h string, p RetryPolicy) {
+	r.retries[h] = p
+}
+
+// DeadLetters - list messages in dead-letter queue, messages stay in queue
+func (r *RPC) DeadLetters() ([]DeadLetter, error) {
+
+	var letters []DeadLetter
+
+	err := r.browse(r.queueNames().deadLetter, func(d Delivery) bool {
+		letters = append(letters, r.deadLetterOf(d))
+		return false
+	})
+
+	return letters, err
+}
+
+// InspectDeadLetter - get dead-lettered message by id, message stays in queue
+func (r *RPC) InspectDeadLetter(id string) (DeadLetter, error) {
+
+	letters, err := r.DeadLetters()
+	if err != nil {
+		return DeadLetter{}, err
+	}
+
+	for _, l := range letters {
+		if l.ID == id {
+			return l, nil
+		}
+	}
+
+	return DeadLetter{}, ERRDEADLETTERNOTFOUND
+}
+
+// ReinjectDeadLetter - return dead-lettered message to the queue it failed in,
+// handler receives it again with retry attempts starting over
+func (r *RPC) ReinjectDeadLetter(ctx context.Context, id string) error {
+
+	var found *Delivery
+
+	err := r.browse(r.queueNames().deadLetter, func(d Delivery) bool {
+		if v, _ := d.Headers[headerDeadLetterID].(string); v == id {
+			found = &d
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+
+	if found == nil {
+		return ERRDEADLETTERNOTFOUND
+	}
+
+	queue, _ := found.Headers[headerDeadLetterQueue].(string)
+
+	msg := found.Publishing
+	msg.Mandatory = true
+	msg.Headers = make(map[string]interface{})
+	for k, v := range found.Headers {
+		if k == headerAttempt || strings.HasPrefix(k, "x-dead-letter-") {
+			continue
+		}
+		msg.Headers[k] = v
+	}
+
+	if err := r.confirm(ctx, true, "", queue, msg); err != nil {
+		found.Nack(true)
+		return fmt.Errorf("Dead letter reinject: %w", err)
+	}
+
+	return found.Ack()
+}
+
+// settle acknowledges handled delivery, failed delivery of handler with retry policy
+// is delivered again after delay and dead-lettered when attempts are exhausted.
+// Handler result is passed to reply unless delivery is retried
+func (r *RPC) settle(d Delivery, s Sender, handler string, out []byte, err error, reply func([]byte, error)) {
+
+	policy, ok := r.retries[handler]
+	if err == nil || !ok {
+		reply(out, err)
+		d.Ack()
+		return
+	}
+
+	attempt := int(headerInt(d.Headers[headerAttempt]))
+
+	if attempt < policy.Attempts {
+		if e := r.retry(d, attempt+1, policy.Delay); e != nil {
+			r.logger.Error("message retry failed", fieldSender(s), fieldHandler(handler), fieldDelivery(d), fieldErr(e))
+			d.Nack(true)
+			return
+		}
+
+		r.logger.Warn("message retry scheduled", fieldSender(s), fieldHandler(handler), fieldDelivery(d),
+			Field{"attempt", attempt + 1}, Field{"delay", policy.Delay})
+		d.Ack()
+		return
+	}
+
+	if e := r.deadLetter(d, handler, attempt, err); e != nil {
+		r.logger.Error("message dead-letter failed", fieldSender(s), fieldHandler(handler), fieldDelivery(d), fieldErr(e))
+		d.Nack(true)
+		return
+	}
+
+	r.logger.Warn("message dead-lettered", fieldSender(s), fieldHandler(handler), fieldDelivery(d), fieldErr(err))
+
+	reply(out, err)
+	d.Ack()
+}
+
+// retry publishes delivery to delay queue of the queue it was consumed from,
+// delay queue expires message back to the original queue
+func (r *RPC) retry(d Delivery, attempt int, delay time.Duration) error {
+
+	// consumer tag is the name of consumed queue
+	queue := d.ConsumerTag
+
+	msg := d.Publishing
+	msg.Headers = make(map[string]interface{})
+	for k, v := range d.Headers {
+		msg.Headers[k] = v
+	}
+	msg.Headers[headerAttempt] = int64(attempt)
+
+	if delay <= 0 {
+		return r.confirm(context.Background(), true, "", queue, msg)
+	}
+
+	// delay queue passes message back to consumed queue through default exchange
+	ms := delay.Milliseconds()
+	retry := fmt.Sprintf("%s:retry:%d", queue, ms)
+
+	if err := r.delayQueue(retry, "", queue, ms); err != nil {
+		return err
+	}
+
+	return r.confirm(context.Background(), true, "", retry, msg)
+}
+
+// deadLetter publishes delivery with failure reason to dead-letter exchange
+func (r *RPC) deadLetter(d Delivery, handler string, attempt int, reason error) error {
+
+	// dead-lettered message is kept until it is inspected
+	msg := d.Publishing
+	msg.ReplyTo = ""
+	msg.Expiration = 0
+	msg.Headers = make(map[string]interface{})
+	for k, v := range d.Headers {
+		msg.Headers[k] = v
+	}
+
+	msg.Headers[headerAttempt] = int64(attempt)
+	msg.Headers[headerDeadLetterID] = uuid.NewV4().String()
+	msg.Headers[headerDeadLetterReason] = reason.Error()
+	msg.Headers[headerDeadLetterHandler] = handler
+	msg.Headers[headerDeadLetterQueue] = d.ConsumerTag
+	msg.Headers[headerDeadLetterTime] = time.Now().UnixNano()
+
+	return r.confirm(context.Background(), true, r.exchanges.deadLetter, strings.ToLower(r.name), msg)
+}
+
+// browse passes deliveries of queue to f until it returns true, delivery f stopped on
+// is left to caller to acknowledge and other browsed deliveries are returned to queue
+func (r *RPC) browse(queue string, f func(d Delivery) bool) error {
+
+	if r.transport == nil || queue == "" {
+		return ERRNOTCONNECTED
+	}
+
+	var held []Delivery
+	defer func() {
+		// requeue in reverse order to keep messages order
+		for i := len(held) - 1; i >= 0; i-- {
+			held[i].Nack(true)
+		}
+	}()
+
+	for {
+		d, ok, err := r.transport.Get(queue)
+		if err != nil || !ok {
+			return err
+		}
+
+		if f(d) {
+			return nil
+		}
+
+		held = append(held, d)
+	}
+}
+
+func (r *RPC) deadLetterOf(d Delivery) DeadLetter {
+
+	l := DeadLetter{
+		Attempts:    int(headerInt(d.Headers[headerAttempt])),
+		Time:        time.Unix(0, headerInt(d.Headers[headerDeadLetterTime])),
+		ContentType: d.ContentType,
+		Body:        d.Body,
+	}
+
+	l.ID, _ = d.Headers[headerDeadLetterID].(string)
+	l.Reason, _ = d.Headers[headerDeadLetterReason].(string)
+	l.Handler, _ = d.Headers[headerDeadLetterHandler].(string)
+	l.Queue, _ = d.Headers[headerDeadLetterQueue].(string)
+
+	// raw envelope is kept as body when message can not be decoded anymore
+	if s, e, p, data, err := r.decode(d.Body, d.Headers); err == nil {
+		l.Sender, l.Destination, l.Receiver, l.Body = s, e, p, data
+	}
+
+	return l
+}
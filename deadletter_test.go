@@ -0,0 +1,128 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDeadLetterRetry(t *testing.T) {
+
+	b := NewMemoryBroker()
+
+	var calls int32
+
+	r, _ := Register("test-retry", "uuid", "token")
+	r.SetRetryPolicy("handler", RetryPolicy{Attempts: 2, Delay: time.Millisecond * 20})
+	r.SetReplyHandler("handler", func(s Sender, p []byte) ([]byte, error) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			return nil, errors.New("temporary failure")
+		}
+		return p, nil
+	})
+	listenMemory(t, b, r)
+	defer r.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	d := Destination{Name: "test-retry", Handler: "handler"}
+
+	out, err := r.RequestBinary(ctx, d, []byte("payload"))
+	if err != nil {
+		t.Fatal("Request failed:", err)
+	}
+
+	if string(out) != "payload" {
+		t.Errorf("Expected reply: %s got %s", "payload", out)
+	}
+
+	if n := atomic.LoadInt32(&calls); n != 3 {
+		t.Errorf("Expected handler calls: %d got %d", 3, n)
+	}
+}
+
+func TestDeadLetterReinject(t *testing.T) {
+
+	b := NewMemoryBroker()
+
+	var fail int32 = 1
+	received := make(chan []byte, 10)
+
+	r, _ := Register("test-dead-letter", "uuid", "token")
+	r.SetRetryPolicy("handler", RetryPolicy{Attempts: 1, Delay: time.Millisecond * 10})
+	r.SetHandler("handler", func(s Sender, p []byte) error {
+		received <- p
+		if atomic.LoadInt32(&fail) == 1 {
+			return errors.New("permanent failure")
+		}
+		return nil
+	})
+	listenMemory(t, b, r)
+	defer r.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	d := Destination{Name: "test-dead-letter", Handler: "handler"}
+
+	if _, err := r.RequestBinary(ctx, d, []byte("payload")); err == nil || err.Error() != "permanent failure" {
+		t.Fatalf("Expected error: %s got %v", "permanent failure", err)
+	}
+
+	// first delivery and one retry
+	if n := len(received); n != 2 {
+		t.Errorf("Expected handler calls: %d got %d", 2, n)
+	}
+
+	letters, err := r.DeadLetters()
+	if err != nil {
+		t.Fatal("Dead letters list failed:", err)
+	}
+
+	if len(letters) != 1 {
+		t.Fatalf("Expected dead letters: %d got %d", 1, len(letters))
+	}
+
+	l := letters[0]
+	if l.Reason != "permanent failure" || l.Handler != "handler" || l.Attempts != 1 {
+		t.Errorf("Unexpected dead letter: %+v", l)
+	}
+
+	if string(l.Body) != "payload" || l.Destination.Handler != "handler" || l.Sender.Name != "test-dead-letter" {
+		t.Errorf("Unexpected dead letter message: %+v", l)
+	}
+
+	// listing does not remove messages
+	if i, err := r.InspectDeadLetter(l.ID); err != nil || i.ID != l.ID {
+		t.Errorf("Expected dead letter %s got %v", l.ID, err)
+	}
+
+	if _, err := r.InspectDeadLetter("unknown"); err != ERRDEADLETTERNOTFOUND {
+		t.Errorf("Expected error: %s got %v", ERRDEADLETTERNOTFOUND, err)
+	}
+
+	for len(received) > 0 {
+		<-received
+	}
+
+	atomic.StoreInt32(&fail, 0)
+	if err := r.ReinjectDeadLetter(ctx, l.ID); err != nil {
+		t.Fatal("Reinject failed:", err)
+	}
+
+	select {
+	case p := <-received:
+		if string(p) != "payload" {
+			t.Errorf("Expected message: %s got %s", "payload", p)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Reinjected message is not received")
+	}
+
+	if letters, _ := r.DeadLetters(); len(letters) != 0 {
+		t.Errorf("Expected dead letters: %d got %d", 0, len(letters))
+	}
+}
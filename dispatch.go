@@ -0,0 +1,173 @@
+package rpc
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// dispatcher - bounded pool of workers running handlers for deliveries of all consumers
+// of one connection, it is closed once all its consumers stopped and handlers finished
+type dispatcher struct {
+	size int
+	jobs chan func()
+
+	mutex   sync.Mutex
+	running map[*settleOnce]Delivery
+	queues  map[string]bool
+
+	consumers sync.WaitGroup
+	workers   sync.WaitGroup
+	done      chan struct{}
+}
+
+// settleOnce - acknowledger settling delivery only once, so delivery requeued
+// on shutdown deadline is not acknowledged by handler finishing later
+type settleOnce struct {
+	Acknowledger
+	settled int32
+}
+
+// newDispatcher starts size workers, handlers are not bounded when size is not positive
+func newDispatcher(size int) *dispatcher {
+
+	p := &dispatcher{
+		size:    size,
+		jobs:    make(chan func()),
+		running: make(map[*settleOnce]Delivery),
+		queues:  make(map[string]bool),
+		done:    make(chan struct{}),
+	}
+
+	for i := 0; i < size; i++ {
+		p.workers.Add(1)
+		go func() {
+			defer p.workers.Done()
+			for job := range p.jobs {
+				job()
+			}
+		}()
+	}
+
+	return p
+}
+
+// consume runs consumer loop of queue submitting deliveries to dispatcher
+func (p *dispatcher) consume(queue string, f func()) {
+	p.consumers.Add(1)
+	p.watch(queue, func() {
+		defer p.consumers.Done()
+		f()
+	})
+}
+
+// watch runs consumer loop of queue and tracks whether queue is consumed
+func (p *dispatcher) watch(queue string, f func()) {
+	p.consuming(queue, true)
+	go func() {
+		defer p.consuming(queue, false)
+		f()
+	}()
+}
+
+func (p *dispatcher) consuming(queue string, ok bool) {
+	p.mutex.Lock()
+	p.queues[queue] = ok
+	p.mutex.Unlock()
+}
+
+// consumed returns consuming state per queue
+func (p *dispatcher) consumed() map[string]bool {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	queues := make(map[string]bool, len(p.queues))
+	for q, ok := range p.queues {
+		queues[q] = ok
+	}
+	return queues
+}
+
+// seal closes dispatcher after consumers started so far stopped and their handlers finished
+func (p *dispatcher) seal() {
+	go func() {
+		p.consumers.Wait()
+		close(p.jobs)
+		p.workers.Wait()
+		close(p.done)
+	}()
+}
+
+// submit passes delivery job to free worker, it blocks while all workers are busy
+func (p *dispatcher) submit(d Delivery, job func(d Delivery)) {
+
+	a := &settleOnce{Acknowledger: d.Acknowledger}
+	d.Acknowledger = a
+
+	p.mutex.Lock()
+	p.running[a] = d
+	p.mutex.Unlock()
+
+	run := func() {
+		defer func() {
+			p.mutex.Lock()
+			delete(p.running, a)
+			p.mutex.Unlock()
+		}()
+
+		// delivery requeued by abandon while waiting for worker is not handled
+		if a.isSettled() {
+			return
+		}
+		job(d)
+	}
+
+	if p.size > 0 {
+		p.jobs <- run
+		return
+	}
+
+	p.workers.Add(1)
+	go func() {
+		defer p.workers.Done()
+		run()
+	}()
+}
+
+// inflight returns number of submitted deliveries not settled by handlers yet
+func (p *dispatcher) inflight() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return len(p.running)
+}
+
+// abandon requeues deliveries of handlers still running, it returns number of requeued deliveries
+func (p *dispatcher) abandon() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	n := 0
+	for _, d := range p.running {
+		if err := d.Nack(true); err == nil {
+			n++
+		}
+	}
+	return n
+}
+
+func (a *settleOnce) isSettled() bool {
+	return atomic.LoadInt32(&a.settled) == 1
+}
+
+func (a *settleOnce) Ack(tag uint64) error {
+	if !atomic.CompareAndSwapInt32(&a.settled, 0, 1) {
+		return nil
+	}
+	return a.Acknowledger.Ack(tag)
+}
+
+func (a *settleOnce) Nack(tag uint64, requeue bool) error {
+	if !atomic.CompareAndSwapInt32(&a.settled, 0, 1) {
+		return nil
+	}
+	return a.Acknowledger.Nack(tag, requeue)
+}
@@ -0,0 +1,210 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestDispatchLimit(t *testing.T) {
+
+	b := NewMemoryBroker()
+
+	var running, max int32
+	var wg sync.WaitGroup
+
+	r, _ := Register("test-dispatch-limit", "uuid", "token")
+	r.SetLimit(2)
+	r.SetHandler("handler", func(s Sender, p []byte) error {
+		defer wg.Done()
+
+		n := atomic.AddInt32(&running, 1)
+		defer atomic.AddInt32(&running, -1)
+
+		for {
+			m := atomic.LoadInt32(&max)
+			if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+				break
+			}
+		}
+
+		time.Sleep(time.Millisecond * 20)
+		return nil
+	})
+	listenMemory(t, b, r)
+	defer r.Shutdown()
+
+	// messages are consumed from common, direct and topic queues
+	for i := 0; i < 3; i++ {
+		wg.Add(3)
+		r.CallBinary(Destination{Name: "test-dispatch-limit", Handler: "handler"}, []byte{})
+		r.CallBinary(Destination{Name: "test-dispatch-limit", UUID: "uuid", Handler: "handler"}, []byte{})
+		r.CastBinary(Destination{Name: "test-dispatch-limit", Handler: "handler"}, []byte{})
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Messages are not handled")
+	}
+
+	if m := atomic.LoadInt32(&max); m != 2 {
+		t.Errorf("Expected concurrent handlers: %d got %d", 2, m)
+	}
+}
+
+func TestDispatchShutdown(t *testing.T) {
+
+	const total = 20
+
+	b := NewMemoryBroker()
+
+	var mutex sync.Mutex
+	handled := make(map[string]int)
+
+	r, _ := Register("test-dispatch-shutdown", "uuid", "token")
+	r.SetLimit(4)
+	r.SetHandler("handler", func(s Sender, p []byte) error {
+		time.Sleep(time.Millisecond * 10)
+		mutex.Lock()
+		handled[string(p)]++
+		mutex.Unlock()
+		return nil
+	})
+	listenMemory(t, b, r)
+
+	d := Destination{Name: "test-dispatch-shutdown", Handler: "handler"}
+	for i := 0; i < total; i++ {
+		if err := r.CallBinary(d, []byte(fmt.Sprintf("message-%d", i))); err != nil {
+			t.Fatal("Call failed:", err)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 15)
+	r.Shutdown()
+
+	// messages handled before shutdown are acknowledged, the rest stay in queue
+	b.mutex.Lock()
+	queued := len(b.queues["test-dispatch-shutdown:direct"].messages)
+	b.mutex.Unlock()
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if len(handled) == 0 || len(handled) == total {
+		t.Errorf("Expected shutdown while handling, handled %d of %d", len(handled), total)
+	}
+
+	for m, n := range handled {
+		if n != 1 {
+			t.Errorf("Message %s handled %d times", m, n)
+		}
+	}
+
+	if len(handled)+queued != total {
+		t.Errorf("Expected handled and queued messages: %d got %d and %d", total, len(handled), queued)
+	}
+}
+
+func TestDispatchShutdownDeadline(t *testing.T) {
+
+	b := NewMemoryBroker()
+
+	started := make(chan struct{}, 2)
+	canceled := make(chan struct{}, 2)
+
+	r, _ := Register("test-dispatch-deadline", "uuid", "token")
+	r.SetLimit(2)
+	r.SetHandlerContext("handler", func(ctx context.Context, s Sender, p []byte) error {
+		started <- struct{}{}
+		<-ctx.Done()
+		canceled <- struct{}{}
+		return ctx.Err()
+	})
+	listenMemory(t, b, r)
+
+	d := Destination{Name: "test-dispatch-deadline", Handler: "handler"}
+	for i := 0; i < 3; i++ {
+		r.CallBinary(d, []byte{})
+	}
+
+	<-started
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	if err := r.ShutdownContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected error: %s got %v", context.DeadlineExceeded, err)
+	}
+
+	// unfinished handlers are cancelled and their deliveries requeued with not started one
+	for i := 0; i < 2; i++ {
+		select {
+		case <-canceled:
+		case <-time.After(time.Second):
+			t.Fatal("Handler context is not cancelled")
+		}
+	}
+
+	b.mutex.Lock()
+	queued := len(b.queues["test-dispatch-deadline:direct"].messages)
+	b.mutex.Unlock()
+
+	if queued != 3 {
+		t.Errorf("Expected requeued messages: %d got %d", 3, queued)
+	}
+}
+
+func TestDispatchShutdownDeadlinePending(t *testing.T) {
+
+	b := NewMemoryBroker()
+
+	var calls int32
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+
+	r, _ := Register("test-dispatch-pending", "uuid", "token")
+	r.SetLimit(1)
+	r.SetHandler("handler", func(s Sender, p []byte) error {
+		atomic.AddInt32(&calls, 1)
+		started <- struct{}{}
+		<-release
+		return nil
+	})
+	listenMemory(t, b, r)
+
+	// common and direct queue consumers share single worker,
+	// so the second delivery waits for worker while the first is handled
+	r.CallBinary(Destination{Name: "test-dispatch-pending", Handler: "handler"}, []byte{})
+	<-started
+	r.CallBinary(Destination{Name: "test-dispatch-pending", UUID: "uuid", Handler: "handler"}, []byte{})
+
+	deadline := time.Now().Add(time.Second)
+	for r.Health().Inflight != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*20)
+	defer cancel()
+
+	if err := r.ShutdownContext(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected error: %s got %v", context.DeadlineExceeded, err)
+	}
+
+	close(release)
+	time.Sleep(time.Millisecond * 50)
+
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("Expected handler calls: %d got %d", 1, n)
+	}
+}
@@ -0,0 +1,105 @@
+package rpc
+
+import (
+	"context"
+	"time"
+)
+
+// headerPublishedAt - publish time in nanoseconds, AMQP timestamp property has seconds precision
+const headerPublishedAt = "x-published-at"
+
+// ExpiredHandler - receives messages dropped because they expired before handling
+type ExpiredHandler func(Sender, Destination, []byte)
+
+// WithExpiration - set expiration of messages sent with ctx, it overrides expiration set
+// by SetExpiration. Broker discards message not consumed in time and receiver drops
+// message delivered after expiration, so clocks of applications should be in sync
+func WithExpiration(ctx context.Context, ttl time.Duration) context.Context {
+	return context.WithValue(ctx, expirationKey, ttl)
+}
+
+// Expiration - get expiration of messages sent with ctx
+func Expiration(ctx context.Context) time.Duration {
+	ttl, _ := ctx.Value(expirationKey).(time.Duration)
+	return ttl
+}
+
+// SetExpiration - set default expiration of messages sent to destination handler,
+// expiration without handler applies to all handlers of destination application
+func (r *RPC) SetExpiration(d Destination, ttl time.Duration) {
+	r.mutex.Lock()
+	r.expirations[expirationOf(d.Name, d.Handler)] = ttl
+	r.mutex.Unlock()
+}
+
+// SetExpiredHandler - set handler receiving expired messages dropped by receiver,
+// it is called from consumer routine and should not block
+func (r *RPC) SetExpiredHandler(h ExpiredHandler) {
+	r.mutex.Lock()
+	r.expiredHandler = h
+	r.mutex.Unlock()
+}
+
+// expiration returns expiration of message sent with ctx to destination
+func (r *RPC) expiration(ctx context.Context, d Destination) time.Duration {
+
+	if ttl := Expiration(ctx); ttl > 0 {
+		return ttl
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if ttl, ok := r.expirations[expirationOf(d.Name, d.Handler)]; ok {
+		return ttl
+	}
+
+	return r.expirations[expirationOf(d.Name, "")]
+}
+
+// expired reports delivery received after its expiration, publish time is taken from
+// header and timestamp truncated to seconds by transport is given one second of slack
+func expired(d Delivery, now time.Time) bool {
+
+	if d.Expiration <= 0 {
+		return false
+	}
+
+	published := d.Timestamp
+	if ns := headerInt(d.Headers[headerPublishedAt]); ns > 0 {
+		published = time.Unix(0, ns)
+	} else if !published.IsZero() && published.Nanosecond() == 0 {
+		published = published.Add(time.Second)
+	}
+
+	if published.IsZero() {
+		return false
+	}
+
+	return now.After(published.Add(d.Expiration))
+}
+
+// expire drops expired message, caller waiting for reply receives ERRMESSAGEEXPIRED
+func (r *RPC) expire(d Delivery, s Sender, e Destination, handler string, data []byte) {
+
+	r.logger.Warn("message expired", fieldSender(s), fieldDestination(e), fieldHandler(handler), fieldDelivery(d),
+		Field{"timestamp", d.Timestamp}, Field{"expiration", d.Expiration})
+
+	r.metrics.expired(handler)
+	r.status.expire()
+
+	r.respond(d, s, nil, ERRMESSAGEEXPIRED)
+	d.Ack()
+
+	r.mutex.Lock()
+	h := r.expiredHandler
+	r.mutex.Unlock()
+
+	if h != nil {
+		h(s, e, data)
+	}
+}
+
+func expirationOf(name, handler string) string {
+	return name + ":" + handler
+}
@@ -0,0 +1,143 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestExpiration(t *testing.T) {
+
+	r, _ := Register("test-expiration", "uuid", "token")
+	r.SetExpiration(Destination{Name: "app"}, time.Second)
+	r.SetExpiration(Destination{Name: "app", Handler: "handler"}, time.Minute)
+
+	ctx := context.Background()
+
+	cases := []struct {
+		ctx      context.Context
+		d        Destination
+		expected time.Duration
+	}{
+		{ctx, Destination{Name: "app", Handler: "handler"}, time.Minute},
+		{ctx, Destination{Name: "app", Handler: "other"}, time.Second},
+		{ctx, Destination{Name: "other", Handler: "handler"}, 0},
+		{WithExpiration(ctx, time.Hour), Destination{Name: "app", Handler: "handler"}, time.Hour},
+	}
+
+	for _, c := range cases {
+		if ttl := r.expiration(c.ctx, c.d); ttl != c.expected {
+			t.Errorf("Expected expiration of %s:%s: %s got %s", c.d.Name, c.d.Handler, c.expected, ttl)
+		}
+	}
+}
+
+func TestExpiredDropped(t *testing.T) {
+
+	b := NewMemoryBroker()
+	received := make(chan string, 10)
+	dropped := make(chan string, 10)
+	release := make(chan struct{})
+
+	r, _ := Register("test-expired", "uuid", "token")
+	r.SetHandler("handler", func(s Sender, p []byte) error {
+		if string(p) == "block" {
+			<-release
+		}
+		received <- string(p)
+		return nil
+	})
+	r.SetExpiredHandler(func(s Sender, d Destination, p []byte) {
+		dropped <- string(p)
+	})
+	listenMemory(t, b, r)
+	defer r.Shutdown()
+
+	d := Destination{Name: "test-expired", Handler: "handler"}
+
+	if err := r.CallBinary(d, []byte("block")); err != nil {
+		t.Fatal("Call failed:", err)
+	}
+
+	// message waiting in queue longer than its expiration is discarded by broker
+	ctx := WithExpiration(context.Background(), time.Millisecond*20)
+	if err := r.CallBinaryContext(ctx, d, []byte("stale")); err != nil {
+		t.Fatal("Call failed:", err)
+	}
+	if err := r.CallBinary(d, []byte("fresh")); err != nil {
+		t.Fatal("Call failed:", err)
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	close(release)
+
+	for _, e := range []string{"block", "fresh"} {
+		select {
+		case m := <-received:
+			if m != e {
+				t.Errorf("Expected message: %s got %s", e, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("No message received: failed")
+		}
+	}
+
+	// message published long ago is dropped by receiver
+	body, _ := r.encode(Sender{"test-expired", "uuid"}, d, Receiver{}, []byte("late"))
+	msg := Publishing{
+		Body:       body,
+		Expiration: time.Second,
+		Timestamp:  time.Now().Add(-time.Minute),
+	}
+	if err := r.transport.Publish(context.Background(), "test-expired:direct", "test-expired:call", msg); err != nil {
+		t.Fatal("Publish failed:", err)
+	}
+
+	select {
+	case m := <-dropped:
+		if m != "late" {
+			t.Errorf("Expected expired message: %s got %s", "late", m)
+		}
+	case m := <-received:
+		t.Fatalf("Unexpected delivery of expired message: %s", m)
+	case <-time.After(time.Second):
+		t.Fatal("Expected expired message reported")
+	}
+
+	if n := r.Health().Expired; n != 1 {
+		t.Errorf("Expected expired: %d got %d", 1, n)
+	}
+}
+
+func TestExpiredTimestamp(t *testing.T) {
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 900*int(time.Millisecond), time.UTC)
+	truncated := now.Truncate(time.Second)
+
+	cases := []struct {
+		name     string
+		d        Delivery
+		expected bool
+	}{
+		{"no expiration", Delivery{Publishing: Publishing{Timestamp: truncated}}, false},
+		// AMQP timestamp has seconds precision, so fresh message seems published 900ms ago
+		{"truncated fresh", Delivery{Publishing: Publishing{Timestamp: truncated, Expiration: time.Millisecond * 500}}, false},
+		{"truncated expired", Delivery{Publishing: Publishing{Timestamp: truncated.Add(-time.Second), Expiration: time.Millisecond * 500}}, true},
+		{"header fresh", Delivery{Publishing: Publishing{
+			Timestamp:  truncated,
+			Expiration: time.Millisecond * 500,
+			Headers:    map[string]interface{}{headerPublishedAt: now.Add(-time.Millisecond * 400).UnixNano()},
+		}}, false},
+		{"header expired", Delivery{Publishing: Publishing{
+			Timestamp:  truncated,
+			Expiration: time.Millisecond * 500,
+			Headers:    map[string]interface{}{headerPublishedAt: now.Add(-time.Millisecond * 600).UnixNano()},
+		}}, true},
+	}
+
+	for _, c := range cases {
+		if e := expired(c.d, now); e != c.expected {
+			t.Errorf("Expected %s expired: %t got %t", c.name, c.expected, e)
+		}
+	}
+}
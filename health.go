@@ -0,0 +1,210 @@
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Health - snapshot of RPC connection and consumers state
+type Health struct {
+	Name string `json:"name"`
+	UUID string `json:"uuid"`
+
+	// Online - Listen is called and RPC is not shut down
+	Online bool `json:"online"`
+	// Connected - transport is connected to broker
+	Connected bool `json:"connected"`
+	// Subscribed - exchanges and queues are declared and consumed
+	Subscribed bool `json:"subscribed"`
+	// GaveUp - reconnect attempts are exhausted by reconnect policy
+	GaveUp bool `json:"gave_up"`
+
+	LastError   string    `json:"last_error,omitempty"`
+	LastErrorAt time.Time `json:"last_error_at,omitempty"`
+
+	// Reconnects - dials retried after failed dial since Listen
+	Reconnects int `json:"reconnects"`
+	// Consumers - consuming state per queue
+	Consumers map[string]bool `json:"consumers"`
+	// Inflight - deliveries handled at the moment
+	Inflight int `json:"inflight"`
+	// Expired - deliveries dropped as expired since Register
+	Expired int `json:"expired"`
+}
+
+// status - connection state updated by broker routines
+type status struct {
+	mutex sync.Mutex
+
+	connected   bool
+	dialed      bool
+	subscribed  bool
+	gaveUp      bool
+	lastError   error
+	lastErrorAt time.Time
+	reconnects  int
+	expired     int
+}
+
+// Health - get connection and consumers state snapshot
+func (r *RPC) Health() Health {
+
+	s := &r.status
+	s.mutex.Lock()
+
+	h := Health{
+		Name:       r.name,
+		UUID:       r.uuid,
+		Online:     r.online.Load(),
+		Connected:  s.connected,
+		Subscribed: s.subscribed,
+		GaveUp:     s.gaveUp,
+		Reconnects: s.reconnects,
+		Expired:    s.expired,
+		Consumers:  make(map[string]bool),
+	}
+
+	if s.lastError != nil {
+		h.LastError = s.lastError.Error()
+		h.LastErrorAt = s.lastErrorAt
+	}
+
+	s.mutex.Unlock()
+
+	// consumers belong to the current connection
+	r.mutex.Lock()
+	pool := r.pool
+	r.mutex.Unlock()
+
+	if pool != nil {
+		h.Consumers = pool.consumed()
+		h.Inflight = pool.inflight()
+	}
+
+	return h
+}
+
+// Ready - RPC is connected and consumes all its queues, it is intended for readiness probe
+func (r *RPC) Ready() bool {
+	h := r.Health()
+
+	if !h.Online || !h.Connected || !h.Subscribed {
+		return false
+	}
+
+	for _, ok := range h.Consumers {
+		if !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Live - RPC is listening and did not give up reconnecting, it is intended for liveness probe
+func (r *RPC) Live() bool {
+	h := r.Health()
+	return h.Online && !h.GaveUp
+}
+
+// HealthHandler - HTTP handler serving Health as JSON, "/live" and "/ready" paths
+// serve Live and Ready checks. Status is 503 when check fails or RPC is not ready
+func (r *RPC) HealthHandler() http.Handler {
+
+	mux := http.NewServeMux()
+
+	check := func(ok func() bool) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			writeHealth(w, ok(), r.Health())
+		}
+	}
+
+	mux.Handle("/live", check(r.Live))
+	mux.Handle("/ready", check(r.Ready))
+	mux.Handle("/", check(r.Ready))
+
+	return mux
+}
+
+func writeHealth(w http.ResponseWriter, ok bool, h Health) {
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(h)
+}
+
+func (s *status) connect() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.connected = true
+	s.dialed = true
+}
+
+// wasConnected reports transport connected at least once, so it has consumers and connection to close
+func (s *status) wasConnected() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.dialed
+}
+
+// subscribe marks topology declared, err is set when subscribe failed
+func (s *status) subscribe(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.subscribed = err == nil
+	if err != nil {
+		s.lastError, s.lastErrorAt = err, time.Now()
+	}
+}
+
+// disconnect marks connection lost with err, nil err means graceful close
+func (s *status) disconnect(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.connected = false
+	s.subscribed = false
+	if err != nil {
+		s.lastError, s.lastErrorAt = err, time.Now()
+	}
+}
+
+// ready reports connection with declared topology
+func (s *status) ready() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.connected && s.subscribed
+}
+
+func (s *status) reconnect() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.reconnects++
+}
+
+func (s *status) expire() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.expired++
+}
+
+func (s *status) giveUp(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.gaveUp = true
+	if err != nil {
+		s.lastError, s.lastErrorAt = err, time.Now()
+	}
+}
@@ -0,0 +1,121 @@
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+
+	b := NewMemoryBroker()
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	r, _ := Register("test-health", "uuid", "token")
+	r.SetHandler("handler", func(s Sender, p []byte) error {
+		close(started)
+		<-release
+		return nil
+	})
+
+	if r.Ready() || r.Live() {
+		t.Error("Expected not ready and not live before listen")
+	}
+
+	// connected signal is not read, so it must not block connect
+	r.SetTransport(b.Transport())
+	r.Listen()
+
+	deadline := time.Now().Add(time.Second)
+	for !r.Ready() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 5)
+	}
+
+	h := r.Health()
+	if !h.Online || !h.Connected || !h.Subscribed || !r.Ready() || !r.Live() {
+		t.Fatalf("Expected ready RPC got %+v", h)
+	}
+
+	for _, q := range []string{"test-health:direct", "test-health:uuid:direct"} {
+		if !h.Consumers[q] {
+			t.Errorf("Expected queue %s consumed", q)
+		}
+	}
+
+	if len(h.Consumers) != 4 {
+		t.Errorf("Expected consumers: %d got %d", 4, len(h.Consumers))
+	}
+
+	r.CastBinary(Destination{Name: "test-health", Handler: "handler"}, []byte{})
+	<-started
+
+	if n := r.Health().Inflight; n != 1 {
+		t.Errorf("Expected in-flight: %d got %d", 1, n)
+	}
+	close(release)
+
+	srv := httptest.NewServer(r.HealthHandler())
+	defer srv.Close()
+
+	for _, path := range []string{"/", "/ready", "/live"} {
+		res, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal("Health request failed:", err)
+		}
+
+		var body Health
+		json.NewDecoder(res.Body).Decode(&body)
+		res.Body.Close()
+
+		if res.StatusCode != http.StatusOK || body.Name != "test-health" {
+			t.Errorf("Expected %s status %d got %d with %+v", path, http.StatusOK, res.StatusCode, body)
+		}
+	}
+
+	r.Shutdown()
+
+	if r.Ready() || r.Live() || r.Health().Connected {
+		t.Errorf("Expected not ready after shutdown got %+v", r.Health())
+	}
+
+	res, err := http.Get(srv.URL + "/ready")
+	if err != nil {
+		t.Fatal("Health request failed:", err)
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d got %d", http.StatusServiceUnavailable, res.StatusCode)
+	}
+}
+
+func TestHealthGiveUp(t *testing.T) {
+
+	tr := &failTransport{MemoryTransport: NewMemoryTransport()}
+	gaveUp := make(chan error, 1)
+
+	r, _ := Register("test-health-give-up", "uuid", "token")
+	r.SetTransport(tr)
+	r.SetReconnectPolicy(ReconnectPolicy{
+		InitialDelay: time.Millisecond,
+		MaxAttempts:  3,
+		OnGiveUp: func(err error) {
+			gaveUp <- err
+		},
+	})
+	r.Listen()
+
+	select {
+	case <-gaveUp:
+	case <-time.After(time.Second):
+		t.Fatal("Expected reconnect to give up")
+	}
+
+	h := r.Health()
+	if r.Live() || !h.GaveUp || h.Reconnects != 2 || h.LastError != "connection refused" {
+		t.Errorf("Unexpected health after give up: %+v", h)
+	}
+}
@@ -0,0 +1,105 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+)
+
+// Message - message passed through interceptors
+type Message struct {
+	Sender      Sender
+	Destination Destination
+	Receiver    Receiver
+	ContentType string
+	Body        []byte
+	// Call is true for messages sent with delivery guarantee
+	Call bool
+}
+
+// Invoker - calls handler or upstream with message and returns handler response
+type Invoker func(ctx context.Context, m *Message) ([]byte, error)
+
+// Interceptor - wraps handler and upstream calls, it should call next to continue
+type Interceptor func(ctx context.Context, m *Message, next Invoker) ([]byte, error)
+
+// Publisher - publishes message to transport
+type Publisher func(ctx context.Context, m *Message) error
+
+// ClientInterceptor - wraps message publishing, it should call next to continue
+type ClientInterceptor func(ctx context.Context, m *Message, next Publisher) error
+
+type route struct {
+	invoke       Invoker
+	interceptors []Interceptor
+	// stream - handler replies with stream frames instead of single reply
+	stream bool
+}
+
+// PanicError - handler panic recovered by RecoverInterceptor
+type PanicError struct {
+	Value interface{}
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("Handler panic: %v", e.Value)
+}
+
+// RecoverInterceptor - recover handler panic and return it as PanicError
+func RecoverInterceptor(ctx context.Context, m *Message, next Invoker) (out []byte, err error) {
+
+	defer func() {
+		if v := recover(); v != nil {
+			out, err = nil, &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+
+	return next(ctx, m)
+}
+
+// UseInterceptor - add interceptors wrapping every handler and upstream call,
+// global interceptors are called before interceptors set with handler
+func (r *RPC) UseInterceptor(i ...Interceptor) {
+	r.interceptors = append(r.interceptors, i...)
+}
+
+// UseClientInterceptor - add interceptors wrapping every published message
+func (r *RPC) UseClientInterceptor(i ...ClientInterceptor) {
+	r.clientInterceptors = append(r.clientInterceptors, i...)
+}
+
+// invoke calls route through global and route interceptors
+func (r *RPC) invoke(ctx context.Context, rt route, m *Message) ([]byte, error) {
+
+	next := rt.invoke
+
+	for i := len(rt.interceptors) - 1; i >= 0; i-- {
+		next = intercept(rt.interceptors[i], next)
+	}
+
+	for i := len(r.interceptors) - 1; i >= 0; i-- {
+		next = intercept(r.interceptors[i], next)
+	}
+
+	return next(ctx, m)
+}
+
+func intercept(i Interceptor, next Invoker) Invoker {
+	return func(ctx context.Context, m *Message) ([]byte, error) {
+		return i(ctx, m, next)
+	}
+}
+
+// publisher wraps publish with client interceptors
+func (r *RPC) publisher(next Publisher) Publisher {
+
+	for i := len(r.clientInterceptors) - 1; i >= 0; i-- {
+		i, n := r.clientInterceptors[i], next
+		next = func(ctx context.Context, m *Message) error {
+			return i(ctx, m, n)
+		}
+	}
+
+	return next
+}
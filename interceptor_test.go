@@ -0,0 +1,80 @@
+package rpc
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInterceptorOrder(t *testing.T) {
+
+	b := NewMemoryBroker()
+	calls := make(chan string, 10)
+
+	trace := func(name string) Interceptor {
+		return func(ctx context.Context, m *Message, next Invoker) ([]byte, error) {
+			calls <- name
+			return next(ctx, m)
+		}
+	}
+
+	r, _ := Register("test-interceptor", "uuid", "token")
+	r.UseInterceptor(trace("global"))
+	r.UseClientInterceptor(func(ctx context.Context, m *Message, next Publisher) error {
+		calls <- "client"
+		if !m.Call {
+			t.Error("Expected call message")
+		}
+		m.Body = []byte("intercepted")
+		return next(ctx, m)
+	})
+
+	r.SetHandler("handler", func(s Sender, p []byte) error {
+		calls <- "handler:" + string(p)
+		return nil
+	}, trace("handler"))
+
+	listenMemory(t, b, r)
+	defer r.Shutdown()
+
+	d := Destination{Name: "test-interceptor", Handler: "handler"}
+	if err := r.CallBinary(d, []byte("message")); err != nil {
+		t.Error("Call failed:", err)
+	}
+
+	expected := []string{"client", "global", "handler", "handler:intercepted"}
+	for _, e := range expected {
+		select {
+		case c := <-calls:
+			if c != e {
+				t.Errorf("Expected call: %s got %s", e, c)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("No message received: failed")
+		}
+	}
+}
+
+func TestInterceptorRecover(t *testing.T) {
+
+	b := NewMemoryBroker()
+
+	r, _ := Register("test-interceptor-recover", "uuid", "token")
+	r.UseInterceptor(RecoverInterceptor)
+	r.SetHandler("handler", func(s Sender, p []byte) error {
+		panic("handler failed")
+	})
+
+	listenMemory(t, b, r)
+	defer r.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	d := Destination{Name: "test-interceptor-recover", Handler: "handler"}
+	_, err := r.RequestBinary(ctx, d, []byte{})
+	if err == nil || !strings.Contains(err.Error(), "handler failed") {
+		t.Errorf("Expected handler panic error, got %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package rpc
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Field - structured log field
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger - leveled structured logger, set with SetLogger.
+// RPC does not log anything by default
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+// Level - StdLogger verbosity
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// StdLogger - Logger writing key=value lines with standard log.Logger
+type StdLogger struct {
+	logger *log.Logger
+	level  Level
+}
+
+type nopLogger struct{}
+
+// NewStdLogger - create logger writing messages with level and above
+func NewStdLogger(l *log.Logger, level Level) *StdLogger {
+	return &StdLogger{logger: l, level: level}
+}
+
+func (l *StdLogger) Debug(msg string, fields ...Field) {
+	l.print(LevelDebug, "DEBUG", msg, fields)
+}
+
+func (l *StdLogger) Info(msg string, fields ...Field) {
+	l.print(LevelInfo, "INFO", msg, fields)
+}
+
+func (l *StdLogger) Warn(msg string, fields ...Field) {
+	l.print(LevelWarn, "WARN", msg, fields)
+}
+
+func (l *StdLogger) Error(msg string, fields ...Field) {
+	l.print(LevelError, "ERROR", msg, fields)
+}
+
+func (l *StdLogger) print(level Level, prefix, msg string, fields []Field) {
+
+	if level < l.level {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString(prefix)
+	b.WriteString(" RPC: ")
+	b.WriteString(msg)
+
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+
+	l.logger.Println(b.String())
+}
+
+func (nopLogger) Debug(string, ...Field) {}
+func (nopLogger) Info(string, ...Field)  {}
+func (nopLogger) Warn(string, ...Field)  {}
+func (nopLogger) Error(string, ...Field) {}
+
+// SetLogger - set logger, RPC is silent by default and nil logger silences it again
+func (r *RPC) SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	r.logger = l
+}
+
+// SetLogPayload - include message bodies into debug logs, bodies are not logged by default
+func (r *RPC) SetLogPayload(enabled bool) {
+	r.logPayload = enabled
+}
+
+// payload returns message body field when payload logging is enabled
+func (r *RPC) payload(body []byte) []Field {
+	if !r.logPayload {
+		return nil
+	}
+	return []Field{{"body", string(body)}}
+}
+
+func fieldErr(err error) Field {
+	return Field{"error", err}
+}
+
+func fieldSender(s Sender) Field {
+	return Field{"sender", s.Name + ":" + s.UUID}
+}
+
+func fieldDestination(d Destination) Field {
+	return Field{"destination", d.Name + ":" + d.UUID}
+}
+
+func fieldHandler(h string) Field {
+	return Field{"handler", h}
+}
+
+func fieldDelivery(d Delivery) Field {
+	return Field{"delivery_tag", d.DeliveryTag}
+}
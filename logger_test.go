@@ -0,0 +1,94 @@
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordLogger struct {
+	mutex   sync.Mutex
+	entries []string
+}
+
+func (l *recordLogger) Debug(msg string, fields ...Field) { l.record(msg, fields) }
+func (l *recordLogger) Info(msg string, fields ...Field)  { l.record(msg, fields) }
+func (l *recordLogger) Warn(msg string, fields ...Field)  { l.record(msg, fields) }
+func (l *recordLogger) Error(msg string, fields ...Field) { l.record(msg, fields) }
+
+func (l *recordLogger) record(msg string, fields []Field) {
+	var b bytes.Buffer
+	NewStdLogger(log.New(&b, "", 0), LevelDebug).Debug(msg, fields...)
+
+	l.mutex.Lock()
+	l.entries = append(l.entries, b.String())
+	l.mutex.Unlock()
+}
+
+func (l *recordLogger) contains(s string) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	for _, e := range l.entries {
+		if strings.Contains(e, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLoggerPayload(t *testing.T) {
+
+	b := NewMemoryBroker()
+	l := &recordLogger{}
+
+	r, _ := Register("test-logger", "uuid", "token")
+	r.SetLogger(l)
+	r.SetReplyHandler("handler", func(s Sender, p []byte) ([]byte, error) {
+		return p, nil
+	})
+	listenMemory(t, b, r)
+	defer r.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	d := Destination{Name: "test-logger", Handler: "handler"}
+
+	if _, err := r.RequestBinary(ctx, d, []byte("secret-payload")); err != nil {
+		t.Fatal("Request failed:", err)
+	}
+
+	if !l.contains("handler=handler") {
+		t.Error("Expected handler field in logs")
+	}
+
+	if l.contains("secret-payload") {
+		t.Error("Expected message body omitted from logs by default")
+	}
+
+	r.SetLogPayload(true)
+	if _, err := r.RequestBinary(ctx, d, []byte("public-payload")); err != nil {
+		t.Fatal("Request failed:", err)
+	}
+
+	if !l.contains("public-payload") {
+		t.Error("Expected message body in logs with payload logging enabled")
+	}
+}
+
+func TestStdLoggerLevel(t *testing.T) {
+
+	var b bytes.Buffer
+	l := NewStdLogger(log.New(&b, "", 0), LevelWarn)
+
+	l.Info("skipped")
+	l.Error("failed", Field{"handler", "demo"})
+
+	if out := b.String(); out != "ERROR RPC: failed handler=demo\n" {
+		t.Errorf("Expected single error line got %q", out)
+	}
+}
@@ -0,0 +1,781 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// MemoryBroker - in-process broker with direct and topic exchanges,
+// it copies routing semantics of AMQP broker used by RPC and is intended
+// for testing handlers without network
+type MemoryBroker struct {
+	mutex sync.Mutex
+
+	exchanges map[string]*memoryExchange
+	queues    map[string]*memoryQueue
+}
+
+// MemoryTransport - connection to MemoryBroker
+type MemoryTransport struct {
+	broker *MemoryBroker
+
+	connected bool
+	consumers map[string]*memoryConsumer
+	closes    []chan error
+	returns   chan Return
+}
+
+type memoryExchange struct {
+	kind     string
+	bindings []memoryBinding
+}
+
+type memoryBinding struct {
+	key   string
+	queue string
+}
+
+type memoryQueue struct {
+	name       string
+	autoDelete bool
+	owner      *MemoryTransport
+
+	// messages expire after ttl and are dead-lettered to exchange when it is set
+	ttl        time.Duration
+	deadLetter *memoryDeadLetter
+	// messages with higher priority up to maxPriority are delivered first
+	maxPriority uint8
+
+	messages  []*memoryMessage
+	consumers []*memoryConsumer
+	next      int
+}
+
+type memoryDeadLetter struct {
+	exchange string
+	key      string
+}
+
+type memoryMessage struct {
+	Publishing
+
+	key     string
+	expires time.Time
+}
+
+type memoryConsumer struct {
+	tag   string
+	queue *memoryQueue
+	conn  *MemoryTransport
+	limit int
+
+	sequence uint64
+	unacked  map[uint64]*memoryMessage
+
+	buffer     []Delivery
+	notify     chan struct{}
+	deliveries chan Delivery
+	canceled   bool
+}
+
+// memoryReturnsSize - returned messages buffered before they are dropped
+const memoryReturnsSize = 128
+
+// NewMemoryBroker - create empty in-process broker
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		exchanges: make(map[string]*memoryExchange),
+		queues:    make(map[string]*memoryQueue),
+	}
+}
+
+// Transport - create new connection to broker, each RPC should use its own connection
+func (b *MemoryBroker) Transport() *MemoryTransport {
+	return &MemoryTransport{
+		broker:    b,
+		consumers: make(map[string]*memoryConsumer),
+		returns:   make(chan Return, memoryReturnsSize),
+	}
+}
+
+// NewMemoryTransport - create transport connected to its own in-process broker
+func NewMemoryTransport() *MemoryTransport {
+	return NewMemoryBroker().Transport()
+}
+
+func (t *MemoryTransport) Dial() error {
+	t.broker.mutex.Lock()
+	defer t.broker.mutex.Unlock()
+
+	t.connected = true
+	return nil
+}
+
+func (t *MemoryTransport) NotifyClose() <-chan error {
+	t.broker.mutex.Lock()
+	defer t.broker.mutex.Unlock()
+
+	closed := make(chan error, 1)
+	t.closes = append(t.closes, closed)
+	return closed
+}
+
+func (t *MemoryTransport) Close() error {
+	b := t.broker
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !t.connected {
+		return ERRNOTCONNECTED
+	}
+	t.connected = false
+
+	// closing connection cancels its consumers and returns unacknowledged messages to queues
+	for _, c := range t.consumers {
+		b.cancel(c)
+		for _, m := range c.unacked {
+			c.queue.messages = append([]*memoryMessage{m}, c.queue.messages...)
+		}
+		c.unacked = make(map[uint64]*memoryMessage)
+		b.dispatch(c.queue)
+
+		if c.queue.autoDelete && len(c.queue.consumers) == 0 {
+			b.delete(c.queue.name)
+		}
+	}
+
+	for name, q := range b.queues {
+		if q.owner == t {
+			b.delete(name)
+		}
+	}
+
+	for _, closed := range t.closes {
+		closed <- nil
+	}
+	t.closes = nil
+
+	return nil
+}
+
+func (t *MemoryTransport) ExchangeDeclare(name, kind string) error {
+	b := t.broker
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !t.connected {
+		return ERRNOTCONNECTED
+	}
+
+	if kind != "direct" && kind != "topic" {
+		return fmt.Errorf("Exchange kind %s is not supported", kind)
+	}
+
+	if e, ok := b.exchanges[name]; ok {
+		if e.kind != kind {
+			return fmt.Errorf("Exchange %s is already declared as %s", name, e.kind)
+		}
+		return nil
+	}
+
+	b.exchanges[name] = &memoryExchange{kind: kind}
+	return nil
+}
+
+func (t *MemoryTransport) ExchangeDelete(name string) error {
+	b := t.broker
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !t.connected {
+		return ERRNOTCONNECTED
+	}
+
+	delete(b.exchanges, name)
+	return nil
+}
+
+func (t *MemoryTransport) QueueDeclare(q Queue) (string, error) {
+	b := t.broker
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !t.connected {
+		return "", ERRNOTCONNECTED
+	}
+
+	if q.Name == "" {
+		q.Name = "amq.gen-" + uuid.NewV4().String()
+	}
+
+	if e, ok := b.queues[q.Name]; ok {
+		if e.owner != nil && e.owner != t {
+			return "", fmt.Errorf("Queue %s is exclusive", q.Name)
+		}
+		return q.Name, nil
+	}
+
+	queue := &memoryQueue{name: q.Name, autoDelete: q.AutoDelete}
+	if q.Exclusive {
+		queue.owner = t
+	}
+
+	if ttl, ok := q.Args["x-message-ttl"]; ok {
+		queue.ttl = time.Duration(headerInt(ttl)) * time.Millisecond
+	}
+
+	if exchange, ok := q.Args["x-dead-letter-exchange"].(string); ok {
+		queue.deadLetter = &memoryDeadLetter{exchange: exchange}
+		queue.deadLetter.key, _ = q.Args["x-dead-letter-routing-key"].(string)
+	}
+
+	if p, ok := q.Args["x-max-priority"]; ok {
+		queue.maxPriority = uint8(headerInt(p))
+	}
+
+	b.queues[q.Name] = queue
+	return q.Name, nil
+}
+
+func (t *MemoryTransport) QueueBind(queue, key, exchange string) error {
+	b := t.broker
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !t.connected {
+		return ERRNOTCONNECTED
+	}
+
+	e, ok := b.exchanges[exchange]
+	if !ok {
+		return fmt.Errorf("Exchange %s not found", exchange)
+	}
+
+	if _, ok := b.queues[queue]; !ok {
+		return fmt.Errorf("Queue %s not found", queue)
+	}
+
+	for _, bind := range e.bindings {
+		if bind.key == key && bind.queue == queue {
+			return nil
+		}
+	}
+
+	e.bindings = append(e.bindings, memoryBinding{key: key, queue: queue})
+	return nil
+}
+
+func (t *MemoryTransport) QueueDelete(name string) error {
+	b := t.broker
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !t.connected {
+		return ERRNOTCONNECTED
+	}
+
+	b.delete(name)
+	return nil
+}
+
+func (t *MemoryTransport) Publish(ctx context.Context, exchange, key string, msg Publishing) error {
+	b := t.broker
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !t.connected {
+		return ERRNOTCONNECTED
+	}
+
+	if !t.publish(exchange, key, msg) {
+		select {
+		case t.returns <- Return{Publishing: msg, Exchange: exchange, Key: key, Reason: "NO_ROUTE"}:
+		default:
+		}
+	}
+
+	return nil
+}
+
+// PublishConfirm - messages are routed synchronously, so they are confirmed once published
+func (t *MemoryTransport) PublishConfirm(ctx context.Context, exchange, key string, msg Publishing) error {
+	b := t.broker
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !t.connected {
+		return ERRNOTCONNECTED
+	}
+
+	if !t.publish(exchange, key, msg) {
+		return ERRNOROUTE
+	}
+
+	return nil
+}
+
+func (t *MemoryTransport) NotifyReturn() <-chan Return {
+	return t.returns
+}
+
+// publish routes message to queues, it reports false for unroutable mandatory message
+func (t *MemoryTransport) publish(exchange, key string, msg Publishing) bool {
+	b := t.broker
+
+	queues := b.route(exchange, key)
+	for _, q := range queues {
+		b.enqueue(q, key, msg)
+	}
+
+	return len(queues) > 0 || !msg.Mandatory
+}
+
+func (t *MemoryTransport) Get(queue string) (Delivery, bool, error) {
+	b := t.broker
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !t.connected {
+		return Delivery{}, false, ERRNOTCONNECTED
+	}
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return Delivery{}, false, fmt.Errorf("Queue %s not found", queue)
+	}
+
+	b.expire(q)
+
+	if len(q.messages) == 0 {
+		return Delivery{}, false, nil
+	}
+
+	m := q.messages[0]
+	q.messages = q.messages[1:]
+
+	// message got from queue is tracked by its own consumer until it is acknowledged
+	c := &memoryConsumer{
+		queue:    q,
+		conn:     t,
+		sequence: 1,
+		unacked:  map[uint64]*memoryMessage{1: m},
+		canceled: true,
+	}
+
+	return Delivery{Publishing: m.Publishing, DeliveryTag: 1, Acknowledger: c}, true, nil
+}
+
+func (t *MemoryTransport) Consume(queue, consumer string, limit int) (<-chan Delivery, error) {
+	b := t.broker
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if !t.connected {
+		return nil, ERRNOTCONNECTED
+	}
+
+	q, ok := b.queues[queue]
+	if !ok {
+		return nil, fmt.Errorf("Queue %s not found", queue)
+	}
+
+	if q.owner != nil && q.owner != t {
+		return nil, fmt.Errorf("Queue %s is exclusive", queue)
+	}
+
+	if _, ok := t.consumers[consumer]; ok {
+		return nil, fmt.Errorf("Consumer %s already exists", consumer)
+	}
+
+	c := &memoryConsumer{
+		tag:        consumer,
+		queue:      q,
+		conn:       t,
+		limit:      limit,
+		unacked:    make(map[uint64]*memoryMessage),
+		notify:     make(chan struct{}, 1),
+		deliveries: make(chan Delivery),
+	}
+
+	t.consumers[consumer] = c
+	q.consumers = append(q.consumers, c)
+
+	go c.run()
+	b.dispatch(q)
+
+	return c.deliveries, nil
+}
+
+func (t *MemoryTransport) Cancel(consumer string) error {
+	b := t.broker
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	c, ok := t.consumers[consumer]
+	if !ok {
+		return nil
+	}
+
+	b.cancel(c)
+
+	if c.queue.autoDelete && len(c.queue.consumers) == 0 {
+		b.delete(c.queue.name)
+	}
+
+	return nil
+}
+
+// route returns queues bound to exchange with matching routing key
+func (b *MemoryBroker) route(exchange, key string) []*memoryQueue {
+
+	var queues []*memoryQueue
+
+	// default exchange routes messages to the queue named by key
+	if exchange == "" {
+		if q, ok := b.queues[key]; ok {
+			queues = append(queues, q)
+		}
+		return queues
+	}
+
+	e, ok := b.exchanges[exchange]
+	if !ok {
+		return queues
+	}
+
+	seen := make(map[string]bool)
+	for _, bind := range e.bindings {
+
+		if seen[bind.queue] {
+			continue
+		}
+
+		match := bind.key == key
+		if e.kind == "topic" {
+			match = matchTopic(strings.Split(bind.key, "."), strings.Split(key, "."))
+		}
+
+		if !match {
+			continue
+		}
+
+		if q, ok := b.queues[bind.queue]; ok {
+			seen[bind.queue] = true
+			queues = append(queues, q)
+		}
+	}
+
+	return queues
+}
+
+// enqueue appends message routed with key to queue
+func (b *MemoryBroker) enqueue(q *memoryQueue, key string, msg Publishing) {
+
+	m := &memoryMessage{Publishing: msg, key: key}
+
+	// message expires with the shortest of queue and message ttl
+	ttl := q.ttl
+	if msg.Expiration > 0 && (ttl == 0 || msg.Expiration < ttl) {
+		ttl = msg.Expiration
+	}
+
+	if ttl > 0 {
+		m.expires = time.Now().Add(ttl)
+		time.AfterFunc(ttl, func() {
+			b.mutex.Lock()
+			defer b.mutex.Unlock()
+
+			if b.queues[q.name] == q {
+				b.expire(q)
+			}
+		})
+	}
+
+	q.insert(m, false)
+	b.dispatch(q)
+}
+
+// insert places message after queued messages of the same or higher priority,
+// requeued message is placed before messages of the same priority
+func (q *memoryQueue) insert(m *memoryMessage, requeue bool) {
+
+	p := q.priority(m)
+
+	i := len(q.messages)
+	for i > 0 {
+		n := q.priority(q.messages[i-1])
+		if n > p || (n == p && !requeue) {
+			break
+		}
+		i--
+	}
+
+	q.messages = append(q.messages, nil)
+	copy(q.messages[i+1:], q.messages[i:])
+	q.messages[i] = m
+}
+
+// priority returns message priority bounded by queue max priority,
+// messages of queue without max priority have the same priority
+func (q *memoryQueue) priority(m *memoryMessage) uint8 {
+	if m.Priority > q.maxPriority {
+		return q.maxPriority
+	}
+	return m.Priority
+}
+
+// expire removes expired messages from queue and passes them to dead-letter exchange
+func (b *MemoryBroker) expire(q *memoryQueue) {
+
+	now := time.Now()
+	messages := q.messages[:0]
+
+	var expired []*memoryMessage
+	for _, m := range q.messages {
+		if !m.expires.IsZero() && !m.expires.After(now) {
+			expired = append(expired, m)
+			continue
+		}
+		messages = append(messages, m)
+	}
+	q.messages = messages
+
+	if q.deadLetter == nil {
+		return
+	}
+
+	for _, m := range expired {
+		key := q.deadLetter.key
+		if key == "" {
+			key = m.key
+		}
+		// dead-lettered message does not expire again with its own expiration
+		msg := m.Publishing
+		msg.Expiration = 0
+		for _, d := range b.route(q.deadLetter.exchange, key) {
+			b.enqueue(d, key, msg)
+		}
+	}
+}
+
+// dispatch passes queued messages to consumers with round-robin,
+// consumer receives no more than limit unacknowledged messages
+func (b *MemoryBroker) dispatch(q *memoryQueue) {
+
+	b.expire(q)
+
+	for len(q.messages) > 0 && len(q.consumers) > 0 {
+
+		var c *memoryConsumer
+		for i := 0; i < len(q.consumers); i++ {
+			n := q.consumers[(q.next+i)%len(q.consumers)]
+			if n.limit <= 0 || len(n.unacked) < n.limit {
+				c = n
+				q.next = (q.next + i + 1) % len(q.consumers)
+				break
+			}
+		}
+
+		if c == nil {
+			return
+		}
+
+		m := q.messages[0]
+		q.messages = q.messages[1:]
+
+		c.sequence++
+		c.unacked[c.sequence] = m
+		c.buffer = append(c.buffer, Delivery{
+			Publishing:   m.Publishing,
+			ConsumerTag:  c.tag,
+			DeliveryTag:  c.sequence,
+			Acknowledger: c,
+		})
+
+		select {
+		case c.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// cancel detaches consumer from queue, deliveries not passed to consumer yet are requeued
+func (b *MemoryBroker) cancel(c *memoryConsumer) {
+
+	if c.canceled {
+		return
+	}
+	c.canceled = true
+
+	delete(c.conn.consumers, c.tag)
+
+	q := c.queue
+	for i, n := range q.consumers {
+		if n == c {
+			q.consumers = append(q.consumers[:i], q.consumers[i+1:]...)
+			break
+		}
+	}
+
+	if len(q.consumers) > 0 {
+		q.next = q.next % len(q.consumers)
+	} else {
+		q.next = 0
+	}
+
+	// requeue in reverse order to keep messages order
+	for i := len(c.buffer) - 1; i >= 0; i-- {
+		tag := c.buffer[i].DeliveryTag
+		q.insert(c.unacked[tag], true)
+		delete(c.unacked, tag)
+	}
+	c.buffer = nil
+
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+
+	b.dispatch(q)
+}
+
+// delete removes queue with its bindings and consumers
+func (b *MemoryBroker) delete(name string) {
+
+	q, ok := b.queues[name]
+	if !ok {
+		return
+	}
+
+	for _, c := range q.consumers {
+		b.cancel(c)
+	}
+
+	delete(b.queues, name)
+
+	for _, e := range b.exchanges {
+		bindings := e.bindings[:0]
+		for _, bind := range e.bindings {
+			if bind.queue != name {
+				bindings = append(bindings, bind)
+			}
+		}
+		e.bindings = bindings
+	}
+}
+
+// run passes buffered deliveries to consumer channel
+func (c *memoryConsumer) run() {
+	b := c.conn.broker
+
+	for {
+		b.mutex.Lock()
+
+		if len(c.buffer) == 0 {
+			canceled := c.canceled
+			b.mutex.Unlock()
+
+			if canceled {
+				close(c.deliveries)
+				return
+			}
+
+			<-c.notify
+			continue
+		}
+
+		d := c.buffer[0]
+		c.buffer = c.buffer[1:]
+		b.mutex.Unlock()
+
+		c.deliveries <- d
+	}
+}
+
+func (c *memoryConsumer) Ack(tag uint64) error {
+	b := c.conn.broker
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if _, ok := c.unacked[tag]; !ok {
+		return fmt.Errorf("Unknown delivery tag %d", tag)
+	}
+
+	delete(c.unacked, tag)
+	b.dispatch(c.queue)
+	return nil
+}
+
+func (c *memoryConsumer) Nack(tag uint64, requeue bool) error {
+	b := c.conn.broker
+
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	m, ok := c.unacked[tag]
+	if !ok {
+		return fmt.Errorf("Unknown delivery tag %d", tag)
+	}
+
+	delete(c.unacked, tag)
+
+	if requeue {
+		c.queue.insert(m, true)
+	}
+
+	b.dispatch(c.queue)
+	return nil
+}
+
+// matchTopic matches routing key words against binding pattern,
+// where "*" matches exactly one word and "#" matches zero or more words
+func matchTopic(pattern, key []string) bool {
+
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+
+	if pattern[0] == "#" {
+		for i := 0; i <= len(key); i++ {
+			if matchTopic(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(key) == 0 {
+		return false
+	}
+
+	if pattern[0] != "*" && pattern[0] != key[0] {
+		return false
+	}
+
+	return matchTopic(pattern[1:], key[1:])
+}
@@ -0,0 +1,469 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func listenMemory(t *testing.T, b *MemoryBroker, r *RPC) {
+	r.SetTransport(b.Transport())
+	r.Listen()
+
+	select {
+	case <-r.Connected():
+	case <-time.After(time.Second):
+		t.Fatal("RPC connection timeout")
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+
+	cases := []struct {
+		pattern string
+		key     string
+		match   bool
+	}{
+		{"demo:cast", "demo:cast", true},
+		{"demo:cast", "demo:call", false},
+		{"demo.*", "demo.cast", true},
+		{"demo.*", "demo.cast.all", false},
+		{"demo.#", "demo.cast.all", true},
+		{"demo.#", "demo", true},
+		{"#.all", "demo.cast.all", true},
+		{"*.all", "demo.cast.all", false},
+	}
+
+	for _, c := range cases {
+		if matchTopic(strings.Split(c.pattern, "."), strings.Split(c.key, ".")) != c.match {
+			t.Errorf("Topic %s match %s: expected %t", c.pattern, c.key, c.match)
+		}
+	}
+}
+
+func TestMemoryCallRouting(t *testing.T) {
+
+	b := NewMemoryBroker()
+	received := make(chan string, 10)
+
+	var apps []*RPC
+	for _, uuid := range []string{"first", "second"} {
+		r, _ := Register("test-memory-call", uuid, "token")
+
+		id := uuid
+		r.SetHandler("handler", func(s Sender, p []byte) error {
+			received <- id
+			return nil
+		})
+
+		listenMemory(t, b, r)
+		defer r.Shutdown()
+		apps = append(apps, r)
+	}
+
+	d := Destination{Name: "test-memory-call", UUID: "second", Handler: "handler"}
+	if err := apps[0].CallBinary(d, []byte{}); err != nil {
+		t.Error("Call failed:", err)
+	}
+
+	select {
+	case id := <-received:
+		if id != "second" {
+			t.Errorf("Expected delivery to: %s got %s", "second", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No message received: failed")
+	}
+
+	// messages to application name are distributed with round-robin
+	d = Destination{Name: "test-memory-call", Handler: "handler"}
+	for i := 0; i < 2; i++ {
+		if err := apps[0].CallBinary(d, []byte{}); err != nil {
+			t.Error("Call failed:", err)
+		}
+	}
+
+	ids := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-received:
+			ids[id] = true
+		case <-time.After(time.Second):
+			t.Fatal("No message received: failed")
+		}
+	}
+
+	if len(ids) != 2 {
+		t.Errorf("Expected delivery to both instances, got %v", ids)
+	}
+}
+
+func TestMemoryCastAll(t *testing.T) {
+
+	b := NewMemoryBroker()
+	received := make(chan string, 10)
+
+	var apps []*RPC
+	for _, uuid := range []string{"first", "second"} {
+		r, _ := Register("test-memory-cast", uuid, "token")
+
+		id := uuid
+		r.SetHandler("handler", func(s Sender, p []byte) error {
+			received <- id
+			return nil
+		})
+
+		listenMemory(t, b, r)
+		defer r.Shutdown()
+		apps = append(apps, r)
+	}
+
+	d := Destination{Name: "test-memory-cast", Handler: "handler", All: true}
+	if err := apps[0].CastBinary(d, []byte{}); err != nil {
+		t.Error("Cast failed:", err)
+	}
+
+	ids := make(map[string]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case id := <-received:
+			ids[id] = true
+		case <-time.After(time.Second):
+			t.Fatal("No message received: failed")
+		}
+	}
+
+	if !ids["first"] || !ids["second"] {
+		t.Errorf("Expected delivery to all instances, got %v", ids)
+	}
+
+	// call to application uuid is not delivered to cast queues
+	d = Destination{Name: "test-memory-cast", UUID: "first", Handler: "handler"}
+	if err := apps[0].CallBinary(d, []byte{}); err != nil {
+		t.Error("Call failed:", err)
+	}
+
+	select {
+	case id := <-received:
+		if id != "first" {
+			t.Errorf("Expected delivery to: %s got %s", "first", id)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No message received: failed")
+	}
+
+	select {
+	case id := <-received:
+		t.Errorf("Unexpected delivery to: %s", id)
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestMemoryProxyCall(t *testing.T) {
+
+	b := NewMemoryBroker()
+	end := make(chan Sender)
+
+	proxy, _ := Register("test-memory-proxy", "proxy", "token")
+	proxy.SetUpstream("upstream", func(s Sender, d Destination, p []byte) error {
+		return proxy.CallSignedBinary(s, d, p)
+	})
+	listenMemory(t, b, proxy)
+	defer proxy.Shutdown()
+
+	dest, _ := Register("test-memory-dest", "dest", "token")
+	dest.SetHandler("handler", func(s Sender, p []byte) error {
+		if string(p) != "{}" {
+			t.Errorf("Received message validation failed: %s got %s", "{}", p)
+		}
+		end <- s
+		return nil
+	})
+	listenMemory(t, b, dest)
+	defer dest.Shutdown()
+
+	sender, _ := Register("test-memory-sender", "sender", "token")
+	listenMemory(t, b, sender)
+	defer sender.Shutdown()
+
+	d := Destination{Name: "test-memory-dest", Handler: "handler"}
+	p := Receiver{Name: "test-memory-proxy", Handler: "upstream"}
+
+	if err := sender.ProxyCallBinary(d, p, []byte("{}")); err != nil {
+		t.Error("Proxy call failed:", err)
+	}
+
+	select {
+	case s := <-end:
+		if s.Name != "test-memory-sender" || s.UUID != "sender" {
+			t.Errorf("Received sender validation failed: %v", s)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No message received: failed")
+	}
+}
+
+func TestMemoryRequest(t *testing.T) {
+
+	b := NewMemoryBroker()
+
+	r, _ := Register("test-memory-request", "uuid", "token")
+	r.SetReplyHandler("handler", func(s Sender, p []byte) ([]byte, error) {
+		i := struct{ Name string }{}
+		if err := json.Unmarshal(p, &i); err != nil {
+			return nil, err
+		}
+		i.Name = "re:" + i.Name
+		return json.Marshal(i)
+	})
+	r.SetHandler("fail", func(s Sender, p []byte) error {
+		return ERRINVALIDLENGTH
+	})
+	listenMemory(t, b, r)
+	defer r.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	out := struct{ Name string }{}
+	d := Destination{Name: "test-memory-request", Handler: "handler"}
+	if err := r.Request(ctx, d, struct{ Name string }{"name"}, &out); err != nil {
+		t.Fatal("Request failed:", err)
+	}
+
+	if out.Name != "re:name" {
+		t.Errorf("Received response validation failed: %s got %s", "re:name", out.Name)
+	}
+
+	d = Destination{Name: "test-memory-request", Handler: "fail"}
+	if err := r.Request(ctx, d, struct{}{}, nil); err == nil || err.Error() != ERRINVALIDLENGTH.Error() {
+		t.Errorf("Expected error: %s got %v", ERRINVALIDLENGTH, err)
+	}
+}
+
+func TestMemoryBroadcast(t *testing.T) {
+
+	b := NewMemoryBroker()
+
+	for _, uuid := range []string{"first", "second"} {
+		r, _ := Register("test-memory-broadcast", uuid, "token")
+
+		id := uuid
+		r.SetReplyHandler("state", func(s Sender, p []byte) ([]byte, error) {
+			return json.Marshal(struct{ State string }{"state:" + id})
+		})
+		r.SetHandler("fail", func(s Sender, p []byte) error {
+			return ERRINVALIDLENGTH
+		})
+
+		listenMemory(t, b, r)
+		defer r.Shutdown()
+	}
+
+	sender, _ := Register("test-memory-broadcast-sender", "sender", "token")
+	listenMemory(t, b, sender)
+	defer sender.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	d := Destination{Name: "test-memory-broadcast", Handler: "state"}
+	replies, err := sender.Broadcast(ctx, d, struct{}{}, 2)
+	if err != nil {
+		t.Fatal("Broadcast failed:", err)
+	}
+
+	for _, id := range []string{"first", "second"} {
+		out := struct{ State string }{}
+		if err := sender.DecodeReply(replies[id], &out); err != nil || out.State != "state:"+id {
+			t.Errorf("Expected reply: %s got %q (%v)", "state:"+id, out.State, err)
+		}
+	}
+
+	// replies are collected until timeout when expected number is not set
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	d = Destination{Name: "test-memory-broadcast", Handler: "fail"}
+	replies, err = sender.BroadcastBinary(ctx, d, []byte{}, 0)
+	if err != nil || len(replies) != 2 {
+		t.Fatalf("Expected replies: %d got %d (%v)", 2, len(replies), err)
+	}
+
+	for id, rp := range replies {
+		if rp.Err == nil || rp.Err.Error() != ERRINVALIDLENGTH.Error() || rp.Sender.UUID != id {
+			t.Errorf("Expected error reply of %s got %+v", id, rp)
+		}
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	replies, err = sender.BroadcastBinary(ctx, d, []byte{}, 3)
+	if err != context.DeadlineExceeded || len(replies) != 2 {
+		t.Errorf("Expected %d replies and deadline error got %d (%v)", 2, len(replies), err)
+	}
+}
+
+func TestMemoryRepliesWait(t *testing.T) {
+
+	b := NewMemoryBroker()
+
+	r, _ := Register("test-memory-replies", "uuid", "token")
+	listenMemory(t, b, r)
+	defer r.Shutdown()
+
+	reply := func(id, uuid string) {
+		body, _ := r.encode(Sender{"test-memory-replies", uuid}, Destination{}, Receiver{}, []byte(uuid))
+		msg := Publishing{Body: body, CorrelationID: id}
+		if err := r.transport.Publish(context.Background(), "", r.queueNames().reply, msg); err != nil {
+			t.Fatal("Publish failed:", err)
+		}
+	}
+
+	// replies arriving faster than caller takes them are not dropped
+	wait, done := r.wait("first", 1)
+	for _, uuid := range []string{"a", "b", "c"} {
+		reply("first", uuid)
+	}
+	time.Sleep(time.Millisecond * 50)
+
+	for _, e := range []string{"a", "b", "c"} {
+		select {
+		case rp := <-wait:
+			if rp.sender.UUID != e {
+				t.Errorf("Expected reply of %s got %s", e, rp.sender.UUID)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected reply of %s", e)
+		}
+	}
+
+	// reply to caller which stopped waiting does not block replies to others
+	reply("first", "d")
+	done()
+
+	wait, done = r.wait("second", 1)
+	defer done()
+	reply("second", "e")
+
+	select {
+	case rp := <-wait:
+		if rp.sender.UUID != "e" {
+			t.Errorf("Expected reply of %s got %s", "e", rp.sender.UUID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected reply after caller stopped waiting")
+	}
+}
+
+func TestMemoryPriority(t *testing.T) {
+
+	b := NewMemoryBroker()
+	received := make(chan string, 10)
+	release := make(chan struct{})
+
+	r, _ := Register("test-memory-priority", "uuid", "token")
+	r.SetMaxPriority(5)
+	r.SetHandlerContext("handler", func(ctx context.Context, s Sender, p []byte) error {
+		if string(p) == "block" {
+			<-release
+		}
+		received <- fmt.Sprintf("%s:%d", p, Priority(ctx))
+		return nil
+	})
+	listenMemory(t, b, r)
+	defer r.Shutdown()
+
+	d := Destination{Name: "test-memory-priority", Handler: "handler"}
+
+	// single worker is blocked, so following messages wait in queue
+	if err := r.CallBinary(d, []byte("block")); err != nil {
+		t.Fatal("Call failed:", err)
+	}
+
+	for _, m := range []struct {
+		body     string
+		priority uint8
+	}{{"low", 0}, {"normal", 1}, {"high", 5}, {"above", 9}, {"next", 1}} {
+		ctx := WithPriority(context.Background(), m.priority)
+		if err := r.CallBinaryContext(ctx, d, []byte(m.body)); err != nil {
+			t.Fatal("Call failed:", err)
+		}
+	}
+
+	close(release)
+
+	expected := []string{"block:0", "high:5", "above:9", "normal:1", "next:1", "low:0"}
+	for _, e := range expected {
+		select {
+		case m := <-received:
+			if m != e {
+				t.Errorf("Expected message: %s got %s", e, m)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("No message received: failed")
+		}
+	}
+}
+
+func TestMemoryNoRoute(t *testing.T) {
+
+	b := NewMemoryBroker()
+	returned := make(chan Destination, 1)
+
+	r, _ := Register("test-memory-noroute", "uuid", "token")
+	r.SetReturnHandler(func(d Destination, p []byte) {
+		if string(p) != "payload" {
+			t.Errorf("Expected returned message: %s got %s", "payload", p)
+		}
+		returned <- d
+	})
+	r.SetReplyHandler("handler", func(s Sender, p []byte) ([]byte, error) {
+		return p, nil
+	})
+	listenMemory(t, b, r)
+	defer r.Shutdown()
+
+	d := Destination{Name: "test-memory-noroute", UUID: "unknown", Handler: "handler"}
+
+	if err := r.CallBinary(d, []byte("payload")); !errors.Is(err, ERRNOROUTE) {
+		t.Errorf("Expected error: %s got %v", ERRNOROUTE, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if _, err := r.RequestBinary(ctx, d, []byte("payload")); !errors.Is(err, ERRNOROUTE) {
+		t.Errorf("Expected error: %s got %v", ERRNOROUTE, err)
+	}
+
+	if err := r.CastBinary(d, []byte("payload")); err != nil {
+		t.Error("Cast failed:", err)
+	}
+
+	select {
+	case rd := <-returned:
+		if rd.UUID != d.UUID || rd.Handler != d.Handler {
+			t.Errorf("Expected returned destination: %v got %v", d, rd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected cast message returned")
+	}
+
+	// routed messages are not returned
+	d.UUID = "uuid"
+	if err := r.CallBinary(d, []byte("payload")); err != nil {
+		t.Error("Call failed:", err)
+	}
+
+	select {
+	case rd := <-returned:
+		t.Errorf("Unexpected returned message to %v", rd)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
@@ -0,0 +1,155 @@
+package rpc
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics - prometheus collectors for published and handled messages,
+// one Metrics can be shared by several RPC instances. Metrics methods
+// are safe to call on nil Metrics when metrics are not set
+type Metrics struct {
+	published      *prometheus.CounterVec
+	publishErrors  *prometheus.CounterVec
+	received       *prometheus.CounterVec
+	latency        *prometheus.HistogramVec
+	handlerErrors  *prometheus.CounterVec
+	decodeFailures *prometheus.CounterVec
+	expiries       *prometheus.CounterVec
+	reconnects     prometheus.Counter
+	inflight       prometheus.Gauge
+}
+
+// NewMetrics - create metrics and register them in registerer
+func NewMetrics(reg prometheus.Registerer) (*Metrics, error) {
+
+	m := &Metrics{
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rpc",
+			Name:      "published_total",
+			Help:      "Messages published per destination and delivery mode.",
+		}, []string{"destination", "mode"}),
+		publishErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rpc",
+			Name:      "publish_errors_total",
+			Help:      "Messages failed to publish per destination and delivery mode.",
+		}, []string{"destination", "mode"}),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rpc",
+			Name:      "received_total",
+			Help:      "Deliveries received per handler.",
+		}, []string{"handler"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "rpc",
+			Name:      "handler_duration_seconds",
+			Help:      "Handler execution latency.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"handler"}),
+		handlerErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rpc",
+			Name:      "handler_errors_total",
+			Help:      "Handler errors per handler.",
+		}, []string{"handler"}),
+		decodeFailures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rpc",
+			Name:      "decode_failures_total",
+			Help:      "Deliveries rejected on decode per reason.",
+		}, []string{"reason"}),
+		expiries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "rpc",
+			Name:      "expired_total",
+			Help:      "Deliveries dropped as expired per handler.",
+		}, []string{"handler"}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: "rpc",
+			Name:      "reconnects_total",
+			Help:      "Broker reconnect attempts.",
+		}),
+		inflight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "rpc",
+			Name:      "handlers_inflight",
+			Help:      "Handlers currently running.",
+		}),
+	}
+
+	for _, c := range []prometheus.Collector{
+		m.published, m.publishErrors, m.received, m.latency,
+		m.handlerErrors, m.decodeFailures, m.expiries, m.reconnects, m.inflight,
+	} {
+		if err := reg.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// SetMetrics - set metrics collectors, metrics are not collected by default
+func (r *RPC) SetMetrics(m *Metrics) {
+	r.metrics = m
+}
+
+func (m *Metrics) publish(d Destination, call bool, err error) {
+	if m == nil {
+		return
+	}
+
+	mode := "cast"
+	if call {
+		mode = "call"
+	}
+
+	m.published.WithLabelValues(d.Name, mode).Inc()
+	if err != nil {
+		m.publishErrors.WithLabelValues(d.Name, mode).Inc()
+	}
+}
+
+func (m *Metrics) handle(handler string) func(err error) {
+	if m == nil {
+		return func(error) {}
+	}
+
+	start := time.Now()
+	m.received.WithLabelValues(handler).Inc()
+	m.inflight.Inc()
+
+	return func(err error) {
+		m.inflight.Dec()
+		m.latency.WithLabelValues(handler).Observe(time.Since(start).Seconds())
+		if err != nil {
+			m.handlerErrors.WithLabelValues(handler).Inc()
+		}
+	}
+}
+
+func (m *Metrics) decodeFailed(err error) {
+	if m == nil {
+		return
+	}
+
+	reason := "decode"
+	if err == ERRINVALIDTOKEN {
+		reason = "token"
+	}
+	if _, ok := err.(*SignatureError); ok {
+		reason = "signature"
+	}
+
+	m.decodeFailures.WithLabelValues(reason).Inc()
+}
+
+func (m *Metrics) expired(handler string) {
+	if m == nil {
+		return
+	}
+	m.expiries.WithLabelValues(handler).Inc()
+}
+
+func (m *Metrics) reconnect() {
+	if m == nil {
+		return
+	}
+	m.reconnects.Inc()
+}
@@ -0,0 +1,74 @@
+package rpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetrics(t *testing.T) {
+
+	reg := prometheus.NewRegistry()
+	m, err := NewMetrics(reg)
+	if err != nil {
+		t.Fatal("Metrics register failed:", err)
+	}
+
+	if _, err := NewMetrics(reg); err == nil {
+		t.Error("Expected duplicate metrics registration error")
+	}
+
+	b := NewMemoryBroker()
+
+	r, _ := Register("test-metrics", "uuid", "token")
+	r.SetMetrics(m)
+	r.SetHandler("handler", func(s Sender, p []byte) error {
+		if string(p) == "fail" {
+			return ERRINVALIDLENGTH
+		}
+		return nil
+	})
+	listenMemory(t, b, r)
+	defer r.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	d := Destination{Name: "test-metrics", Handler: "handler"}
+	r.RequestBinary(ctx, d, []byte("ok"))
+	r.RequestBinary(ctx, d, []byte("fail"))
+
+	// message signed with another token
+	o, _ := Register("test-metrics-other", "uuid", "other")
+	listenMemory(t, b, o)
+	defer o.Shutdown()
+	o.CallBinary(d, []byte("ok"))
+
+	deadline := time.Now().Add(time.Second)
+	for testutil.ToFloat64(m.decodeFailures.WithLabelValues("token")) < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if v := testutil.ToFloat64(m.published.WithLabelValues("test-metrics", "call")); v != 2 {
+		t.Errorf("Expected published: %d got %v", 2, v)
+	}
+
+	if v := testutil.ToFloat64(m.received.WithLabelValues("handler")); v != 2 {
+		t.Errorf("Expected received: %d got %v", 2, v)
+	}
+
+	if v := testutil.ToFloat64(m.handlerErrors.WithLabelValues("handler")); v != 1 {
+		t.Errorf("Expected handler errors: %d got %v", 1, v)
+	}
+
+	if v := testutil.ToFloat64(m.decodeFailures.WithLabelValues("token")); v != 1 {
+		t.Errorf("Expected invalid tokens: %d got %v", 1, v)
+	}
+
+	if v := testutil.ToFloat64(m.inflight); v != 0 {
+		t.Errorf("Expected in-flight handlers: %d got %v", 0, v)
+	}
+}
@@ -0,0 +1,381 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// presenceExchange - topic exchange shared by all applications to exchange heartbeats
+const presenceExchange = "presence:topic"
+
+// presenceMisses - number of heartbeats peer may miss before it is considered gone
+const presenceMisses = 3
+
+// Peer - application instance announcing its presence with heartbeats
+type Peer struct {
+	Name     string
+	UUID     string
+	Metadata map[string]string
+	LastSeen time.Time
+}
+
+// PresenceEvent - peer joined or left, peer leaves when it is shut down
+// or when its heartbeats are missed
+type PresenceEvent struct {
+	Peer Peer
+	Left bool
+}
+
+type PresenceHandler func(PresenceEvent)
+
+// heartbeat - presence message body, sender of message is the announced instance
+type heartbeat struct {
+	Interval time.Duration     `json:"interval"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Leave    bool              `json:"leave,omitempty"`
+}
+
+// presence - registry of peers seen by their heartbeats
+type presence struct {
+	mutex sync.Mutex
+
+	interval time.Duration
+	metadata map[string]string
+	handler  PresenceHandler
+
+	// names of applications tracked besides own one
+	watch []string
+
+	// peers by name and uuid
+	peers map[string]map[string]*peer
+
+	// announce serializes heartbeats, so no heartbeat follows leave
+	announce sync.Mutex
+	left     bool
+}
+
+type peer struct {
+	Peer
+	expires time.Time
+}
+
+// SetPresence - announce instance with metadata to other applications every interval
+// and track instances announced by them, presence is disabled when interval is not positive
+func (r *RPC) SetPresence(interval time.Duration, metadata map[string]string) {
+	p := &r.presence
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.interval = interval
+	p.metadata = make(map[string]string, len(metadata))
+	for k, v := range metadata {
+		p.metadata[k] = v
+	}
+}
+
+// WatchPresence - track instances of applications by name besides instances of own
+// application, heartbeats of other applications are not received. Set it before Listen
+func (r *RPC) WatchPresence(names ...string) {
+	p := &r.presence
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.watch = append(p.watch, names...)
+}
+
+// SetPresenceHandler - set handler called when peer joins or leaves
+func (r *RPC) SetPresenceHandler(h PresenceHandler) {
+	p := &r.presence
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	p.handler = h
+}
+
+// Peers - get live instances of own or watched application by name ordered by uuid,
+// this instance is listed too once its own heartbeat is received
+func (r *RPC) Peers(name string) []Peer {
+	p := &r.presence
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	now := time.Now()
+	peers := make([]Peer, 0, len(p.peers[name]))
+
+	for _, i := range p.peers[name] {
+		if now.After(i.expires) {
+			continue
+		}
+		peers = append(peers, i.snapshot())
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].UUID < peers[j].UUID
+	})
+
+	return peers
+}
+
+// announcing reports presence interval, zero interval means presence is disabled
+func (p *presence) announcing() time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.interval
+}
+
+// subscribePresence consumes heartbeats of own and watched applications and announces instance
+func (r *RPC) subscribePresence(pool *dispatcher) error {
+	if err := r.transport.ExchangeDeclare(presenceExchange, "topic"); err != nil {
+		return fmt.Errorf("Exchange Declare: %s", err)
+	}
+
+	queue, err := r.transport.QueueDeclare(Queue{AutoDelete: true, Exclusive: true})
+	if err != nil {
+		return fmt.Errorf("Queue Declare: %s", err)
+	}
+
+	r.mutex.Lock()
+	r.queues.presence = queue
+	r.mutex.Unlock()
+
+	// queue is bound per application, so instance does not receive heartbeats of every application
+	for _, name := range r.presence.watched(r.name) {
+		if err = r.transport.QueueBind(queue, presenceKey(name, "*"), presenceExchange); err != nil {
+			return fmt.Errorf("Queue Bind: %s", err)
+		}
+	}
+
+	mp, err := r.transport.Consume(queue, queue, r.limit)
+	if err != nil {
+		return fmt.Errorf("Queue Consume: %s", err)
+	}
+	pool.watch(queue, func() { r.observe(mp) })
+
+	// peers learn about instance right away instead of waiting for next heartbeat
+	return r.announce(false)
+}
+
+// heartbeat announces instance every presence interval and removes peers
+// which missed their heartbeats until RPC is shut down
+func (r *RPC) heartbeat(interval time.Duration) {
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if r.status.ready() {
+			if err := r.announce(false); err != nil {
+				r.logger.Warn("heartbeat failed", Field{"name", r.name}, fieldErr(err))
+			}
+		}
+
+		r.notify(r.presence.expire(time.Now()))
+	}
+}
+
+// announce publishes heartbeat, leave heartbeat removes instance from peers right away
+func (r *RPC) announce(leave bool) error {
+
+	p := &r.presence
+
+	p.announce.Lock()
+	defer p.announce.Unlock()
+
+	if p.left {
+		return nil
+	}
+	p.left = leave
+
+	p.mutex.Lock()
+	hb := heartbeat{Interval: p.interval, Metadata: p.metadata, Leave: leave}
+	p.mutex.Unlock()
+
+	data, err := json.Marshal(hb)
+	if err != nil {
+		return err
+	}
+
+	body, err := r.encode(Sender{r.name, r.uuid}, Destination{Name: r.name, UUID: r.uuid}, Receiver{}, data)
+	if err != nil {
+		return err
+	}
+
+	msg := Publishing{
+		ContentType: JSONCodec{}.ContentType(),
+		Headers:     r.signed(nil),
+		Body:        body,
+	}
+
+	if err := r.transport.Publish(context.Background(), presenceExchange, presenceKey(r.name, r.uuid), msg); err != nil {
+		return fmt.Errorf("Heartbeat Publish: %s", err)
+	}
+
+	return nil
+}
+
+// observe updates peers with received heartbeats
+func (r *RPC) observe(msgs <-chan Delivery) {
+
+	for d := range msgs {
+
+		d.Ack()
+
+		s, _, _, data, err := r.decode(d.Body, d.Headers)
+		if _, ok := err.(*SignatureError); ok || err == ERRINVALIDTOKEN {
+			// exchange is shared by applications with other tokens and keys
+			r.logger.Debug("heartbeat of foreign application skipped", fieldDelivery(d), fieldErr(err))
+			continue
+		}
+		if err != nil {
+			r.metrics.decodeFailed(err)
+			r.logger.Warn("heartbeat decode failed", fieldDelivery(d), fieldErr(err))
+			continue
+		}
+
+		var hb heartbeat
+		if err := json.Unmarshal(data, &hb); err != nil {
+			r.logger.Warn("heartbeat decode failed", fieldSender(s), fieldDelivery(d), fieldErr(err))
+			continue
+		}
+
+		r.notify(r.presence.seen(s, hb, time.Now()))
+	}
+}
+
+// presenceKey returns heartbeat routing key of instance, dots of uuid would
+// add words to key, so they are replaced to keep single word matched by "*"
+func presenceKey(name, uuid string) string {
+	if uuid != "*" {
+		uuid = strings.Replace(uuid, ".", "_", -1)
+	}
+	return strings.ToLower(name + "." + uuid)
+}
+
+// watched returns names of tracked applications starting with own name
+func (p *presence) watched(name string) []string {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	names := []string{name}
+	for _, n := range p.watch {
+		if n != name {
+			names = append(names, n)
+		}
+	}
+	return names
+}
+
+// notify passes presence events to presence handler
+func (r *RPC) notify(events []PresenceEvent) {
+
+	if len(events) == 0 {
+		return
+	}
+
+	p := &r.presence
+	p.mutex.Lock()
+	h := p.handler
+	p.mutex.Unlock()
+
+	for _, e := range events {
+		r.logger.Debug("presence", Field{"peer", e.Peer.Name + ":" + e.Peer.UUID}, Field{"left", e.Left})
+		if h != nil {
+			h(e)
+		}
+	}
+}
+
+// seen registers heartbeat of sender and returns join or leave event when peer state changed
+func (p *presence) seen(s Sender, hb heartbeat, now time.Time) []PresenceEvent {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.peers == nil {
+		p.peers = make(map[string]map[string]*peer)
+	}
+
+	peers, ok := p.peers[s.Name]
+	if !ok {
+		peers = make(map[string]*peer)
+		p.peers[s.Name] = peers
+	}
+
+	var events []PresenceEvent
+
+	i, known := peers[s.UUID]
+	if known && now.After(i.expires) {
+		// peer missed heartbeats before sweep noticed it, so it leaves and joins anew
+		events = append(events, PresenceEvent{Peer: i.snapshot(), Left: true})
+		delete(peers, s.UUID)
+		known = false
+	}
+
+	if hb.Leave {
+		if known {
+			delete(peers, s.UUID)
+			i.LastSeen = now
+			events = append(events, PresenceEvent{Peer: i.snapshot(), Left: true})
+		}
+		return events
+	}
+
+	if !known {
+		i = &peer{Peer: Peer{Name: s.Name, UUID: s.UUID}}
+		peers[s.UUID] = i
+	}
+
+	i.Metadata = hb.Metadata
+	i.LastSeen = now
+	i.expires = now.Add(presenceMisses * hb.Interval)
+
+	if !known {
+		events = append(events, PresenceEvent{Peer: i.snapshot()})
+	}
+
+	return events
+}
+
+// expire removes peers which missed their heartbeats and returns leave events for them
+func (p *presence) expire(now time.Time) []PresenceEvent {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var events []PresenceEvent
+
+	for name, peers := range p.peers {
+		for id, i := range peers {
+			if !now.After(i.expires) {
+				continue
+			}
+			delete(peers, id)
+			events = append(events, PresenceEvent{Peer: i.snapshot(), Left: true})
+		}
+
+		if len(peers) == 0 {
+			delete(p.peers, name)
+		}
+	}
+
+	return events
+}
+
+func (i *peer) snapshot() Peer {
+	c := i.Peer
+	c.Metadata = make(map[string]string, len(i.Metadata))
+	for k, v := range i.Metadata {
+		c.Metadata[k] = v
+	}
+	return c
+}
@@ -0,0 +1,162 @@
+package rpc
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPresencePeers(t *testing.T) {
+
+	b := NewMemoryBroker()
+	events := make(chan PresenceEvent, 16)
+
+	watcher, _ := Register("test-presence-watcher", "watcher", "token")
+	watcher.SetTransport(b.Transport())
+	watcher.SetPresence(time.Millisecond*20, nil)
+	watcher.WatchPresence("test-presence")
+	watcher.SetPresenceHandler(func(e PresenceEvent) {
+		if e.Peer.Name == "test-presence" {
+			events <- e
+		}
+	})
+	watcher.Listen()
+	defer watcher.Shutdown()
+	<-watcher.Connected()
+
+	r, _ := Register("test-presence", "uuid", "token")
+	r.SetTransport(b.Transport())
+	r.SetPresence(time.Millisecond*20, map[string]string{"zone": "a"})
+	r.Listen()
+	<-r.Connected()
+
+	select {
+	case e := <-events:
+		if e.Left || e.Peer.UUID != "uuid" || e.Peer.Metadata["zone"] != "a" {
+			t.Errorf("Expected join of uuid got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected join event")
+	}
+
+	peers := watcher.Peers("test-presence")
+	if len(peers) != 1 || peers[0].UUID != "uuid" || peers[0].LastSeen.IsZero() {
+		t.Fatalf("Expected peer uuid got %+v", peers)
+	}
+
+	// heartbeats keep peer alive without new join events
+	time.Sleep(time.Millisecond * 100)
+	if n := len(watcher.Peers("test-presence")); n != 1 {
+		t.Errorf("Expected peers: %d got %d", 1, n)
+	}
+
+	r.Shutdown()
+
+	select {
+	case e := <-events:
+		if !e.Left || e.Peer.UUID != "uuid" {
+			t.Errorf("Expected leave of uuid got %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Expected leave event")
+	}
+
+	if n := len(watcher.Peers("test-presence")); n != 0 {
+		t.Errorf("Expected peers: %d got %d", 0, n)
+	}
+}
+
+func TestPresenceWatch(t *testing.T) {
+
+	b := NewMemoryBroker()
+	joined := make(chan string, 16)
+
+	m, _ := NewMetrics(prometheus.NewRegistry())
+
+	watcher, _ := Register("test-presence-watch", "watcher", "token")
+	watcher.SetMetrics(m)
+	watcher.SetTransport(b.Transport())
+	watcher.SetPresence(time.Millisecond*20, nil)
+	watcher.WatchPresence("test-presence-a")
+	watcher.SetPresenceHandler(func(e PresenceEvent) {
+		if !e.Left {
+			joined <- e.Peer.Name + ":" + e.Peer.UUID
+		}
+	})
+	watcher.Listen()
+	defer watcher.Shutdown()
+	<-watcher.Connected()
+
+	// instance of other application and instance with another token are not tracked
+	for _, i := range []struct{ name, uuid, token string }{
+		{"test-presence-b", "b", "token"},
+		{"test-presence-a", "foreign", "other"},
+		{"test-presence-a", "a.host", "token"},
+	} {
+		r, _ := Register(i.name, i.uuid, i.token)
+		r.SetTransport(b.Transport())
+		r.SetPresence(time.Millisecond*20, nil)
+		r.Listen()
+		defer r.Shutdown()
+		<-r.Connected()
+	}
+
+	seen := map[string]bool{}
+	timeout := time.After(time.Millisecond * 200)
+
+	for done := false; !done; {
+		select {
+		case p := <-joined:
+			seen[p] = true
+		case <-timeout:
+			done = true
+		}
+	}
+
+	for _, p := range []string{"test-presence-watch:watcher", "test-presence-a:a.host"} {
+		if !seen[p] {
+			t.Errorf("Expected join of %s", p)
+		}
+	}
+	if len(seen) != 2 {
+		t.Errorf("Expected joins: %d got %v", 2, seen)
+	}
+
+	// heartbeats of instance with another token are not counted as decode failures
+	if v := testutil.ToFloat64(m.decodeFailures.WithLabelValues("token")); v != 0 {
+		t.Errorf("Expected invalid tokens: %d got %v", 0, v)
+	}
+}
+
+func TestPresenceExpire(t *testing.T) {
+
+	var p presence
+	now := time.Now()
+
+	events := p.seen(Sender{"app", "a"}, heartbeat{Interval: time.Second}, now)
+	if len(events) != 1 || events[0].Left {
+		t.Fatalf("Expected join event got %+v", events)
+	}
+
+	if events := p.seen(Sender{"app", "a"}, heartbeat{Interval: time.Second}, now.Add(time.Second)); len(events) != 0 {
+		t.Errorf("Expected no events for known peer got %+v", events)
+	}
+
+	if events := p.expire(now.Add(time.Second * 3)); len(events) != 0 {
+		t.Errorf("Expected no events before misses got %+v", events)
+	}
+
+	events = p.expire(now.Add(time.Second * 5))
+	if len(events) != 1 || !events[0].Left || events[0].Peer.UUID != "a" {
+		t.Errorf("Expected leave event got %+v", events)
+	}
+
+	// missed heartbeats not swept yet are reported as leave before join
+	p.seen(Sender{"app", "b"}, heartbeat{Interval: time.Second}, now)
+	events = p.seen(Sender{"app", "b"}, heartbeat{Interval: time.Second}, now.Add(time.Second*4))
+	if len(events) != 2 || !events[0].Left || events[1].Left {
+		t.Errorf("Expected leave and join events got %+v", events)
+	}
+}
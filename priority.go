@@ -0,0 +1,31 @@
+package rpc
+
+import "context"
+
+// SetMaxPriority - declare application queues as priority queues with priorities from 0 up to p,
+// messages with higher priority are delivered first. Broker does not change arguments of declared
+// queue, so durable queues declared before with another max priority should be deleted first
+func (r *RPC) SetMaxPriority(p uint8) {
+	r.maxPriority = p
+}
+
+// WithPriority - set priority of messages sent with ctx, priority above max priority
+// of destination queue is treated as max priority
+func WithPriority(ctx context.Context, p uint8) context.Context {
+	return context.WithValue(ctx, priorityKey, p)
+}
+
+// Priority - get priority of messages sent with ctx, handler context carries priority
+// of handled message, so messages sent with it keep the same priority
+func Priority(ctx context.Context) uint8 {
+	p, _ := ctx.Value(priorityKey).(uint8)
+	return p
+}
+
+// queueArgs returns arguments of application queues consumed by handlers
+func (r *RPC) queueArgs() map[string]interface{} {
+	if r.maxPriority == 0 {
+		return nil
+	}
+	return map[string]interface{}{"x-max-priority": int64(r.maxPriority)}
+}
@@ -0,0 +1,66 @@
+package rpc
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// ReconnectPolicy - broker reconnect backoff, delay between failed connect
+// attempts grows from InitialDelay by Multiplier up to MaxDelay
+type ReconnectPolicy struct {
+	// InitialDelay - delay before the first retry
+	InitialDelay time.Duration
+	// MaxDelay - upper bound of delay between retries
+	MaxDelay time.Duration
+	// Multiplier - delay growth factor, values below 1 keep delay constant
+	Multiplier float64
+	// Jitter - fraction of delay randomized in both directions, from 0 to 1
+	Jitter float64
+	// MaxAttempts - connect attempts in a row before giving up, 0 retries forever
+	MaxAttempts int
+	// OnGiveUp - called with the last dial error when attempts are exhausted
+	OnGiveUp func(err error)
+}
+
+// DefaultReconnectPolicy - retry forever starting from one second up to 30 seconds
+func DefaultReconnectPolicy() ReconnectPolicy {
+	return ReconnectPolicy{
+		InitialDelay: time.Second,
+		MaxDelay:     30 * time.Second,
+		Multiplier:   2,
+		Jitter:       0.2,
+	}
+}
+
+// SetReconnectPolicy - set broker reconnect policy, DefaultReconnectPolicy is used by default
+func (r *RPC) SetReconnectPolicy(p ReconnectPolicy) {
+	r.policy = p
+}
+
+// delay returns backoff before retry following failed attempt
+func (p ReconnectPolicy) delay(attempt int) time.Duration {
+
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+
+	d := float64(p.InitialDelay) * math.Pow(multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+
+	jitter := math.Min(math.Max(p.Jitter, 0), 1)
+	d += d * jitter * (2*rand.Float64() - 1)
+
+	if d < 0 {
+		return 0
+	}
+	return time.Duration(d)
+}
+
+// exhausted reports whether no more connect attempts are allowed
+func (p ReconnectPolicy) exhausted(attempt int) bool {
+	return p.MaxAttempts > 0 && attempt >= p.MaxAttempts
+}
@@ -20,10 +20,96 @@ You should start with your app registering:
 		r.SetHandler("handler",   SomeHandler)
 	}
 
+Messages are sent through Transport, AMQP transport connected by URI is used by default.
+In-memory transport allows to run handlers without broker, for example in tests:
+	r := rpc.Register()
+	r.SetTransport(rpc.NewMemoryTransport())
+
+Call and other call mode methods return once broker confirms message, broker nack is returned
+as ERRPUBLISHNACK and missing confirm as ERRCONFIRMTIMEOUT after timeout set by SetConfirmTimeout.
+Cast methods publish messages without waiting for confirm. Messages not routed to any queue,
+for example sent to unknown uuid, fail call with ERRNOROUTE and cast messages are passed to
+handler set by SetReturnHandler.
+
+Broadcast sends message to all instances of application and collects handler responses
+by instance uuid until expected number of instances replied or ctx is done:
+	replies, err := r.Broadcast(ctx, rpc.Destination{Name: "app", Handler: "state"}, nil, len(r.Peers("app")))
+
+Streaming handlers send sequence of messages back to caller of Stream, frames carry sequence
+number and end of stream marker in message envelope, so reader receives them in order:
+	r.SetStreamHandler("tail", func(ctx context.Context, s rpc.Sender, p []byte, st *rpc.Stream) error {
+		return st.Send(line)
+	})
+	sr, err := r.Stream(ctx, rpc.Destination{Name: "app", Handler: "tail"}, nil)
+	for data, err := sr.Recv(); err == nil; data, err = sr.Recv() {
+	}
+
+Application queues are declared as priority queues with SetMaxPriority, message priority is set
+with context passed to CallContext, CastContext, Request and other context aware send methods:
+	r.SetMaxPriority(10)
+	r.CallContext(rpc.WithPriority(ctx, 10), rpc.Destination{Name: "app", Handler: "stop"}, nil)
+
+Messages expire after expiration set with context or by SetExpiration per destination handler,
+broker discards messages not consumed in time and receiver drops messages delivered too late,
+dropped messages are counted and passed to handler set by SetExpiredHandler:
+	r.SetExpiration(rpc.Destination{Name: "app", Handler: "refresh"}, 5*time.Second)
+	r.CastContext(rpc.WithExpiration(ctx, time.Second), rpc.Destination{Name: "app", Handler: "ping"}, nil)
+
+CallAt and CallAfter schedule messages with per-delay queues passing them to destination
+exchange once delay expired, so no broker plugin is needed. Returned id cancels scheduled message:
+	id, err := r.CallAfter(time.Hour, rpc.Destination{Name: "app", Handler: "remind"}, reminder)
+	err = r.CancelScheduled(id)
+
+Messages failed by handler with retry policy are delivered again after delay, when attempts
+are exhausted they are moved to the "name:dead-letter" queue with failure reason in headers:
+	r.SetRetryPolicy("handler", rpc.RetryPolicy{Attempts: 3, Delay: time.Second})
+Dead-lettered messages are listed with DeadLetters and sent back to handler with ReinjectDeadLetter.
+
+ShutdownContext stops consuming and waits for running handlers until deadline,
+deliveries of handlers not finished in time are requeued:
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	r.ShutdownContext(ctx)
+
+Health returns connection, consumers and in-flight handlers state, Ready and Live checks
+are intended for readiness and liveness probes and are served with HealthHandler:
+	http.Handle("/health/", http.StripPrefix("/health", r.HealthHandler()))
+
+Instances with presence enabled announce themselves with metadata over the shared "presence:topic"
+exchange, Peers lists live instances of own application and applications set with WatchPresence,
+presence handler receives their join and leave events:
+	r.SetPresence(5*time.Second, map[string]string{"zone": "a"})
+	r.WatchPresence("app")
+	peers := r.Peers("app")
+
+Lost broker connection is restored with exponential backoff set by SetReconnectPolicy,
+by default RPC retries forever with delay growing from one second up to 30 seconds.
+
+Messages sent with Call, Cast, Request and other non binary methods are encoded with codec
+set by SetCodec, JSON is used by default. Content type travels with message, so handler
+decodes it with matching codec:
+
+	func SomeHandlerContext(ctx context.Context, s rpc.Sender, message []byte) error {
+		var m Message
+		if err := r.Decode(ctx, message, &m); err != nil {
+			return err
+		}
+	}
+
+Interceptors wrap handler and upstream calls, they can be set for all handlers
+or for single handler, client interceptors wrap message publishing:
+	r.UseInterceptor(rpc.RecoverInterceptor)
+	r.SetHandler("handler", SomeHandler, SomeInterceptor)
+
+RPC is silent by default, set Logger to receive leveled logs with sender, destination,
+handler and delivery tag fields. Message bodies are logged only with SetLogPayload:
+	r.SetLogger(rpc.NewStdLogger(log.New(os.Stderr, "", log.LstdFlags), rpc.LevelInfo))
+
 Setup handler and upstream examples:
 	r := rpc.Register()
 	r.SetHandler("handler",   SomeHandler)
 	r.SetUpstream("upstream", SomeUpstream)
+	r.SetReplyHandler("reply", SomeReplyHandler)
 
 Handlers and Upstreams examples:
 
@@ -36,9 +122,29 @@ Handlers and Upstreams examples:
  	func SomeUpstream(s rpc.Sender, r rpc.Recipient, message []byte) error {
 
  	}
+
+ 	// SomeReplyHandler definition, returned data is sent back to rpc.Request caller
+ 	func SomeReplyHandler(s rpc.Sender, message []byte) ([]byte, error) {
+
+ 	}
+
+Handlers and Upstreams set with SetHandlerContext, SetUpstreamContext and SetReplyHandlerContext
+receive per-delivery context. It is cancelled on Shutdown and carries the deadline set by caller
+with CallContext, CastContext, Request and other context aware send methods:
+
+ 	// SomeHandlerContext definition
+ 	func SomeHandlerContext(ctx context.Context, s rpc.Sender, message []byte) error {
+
+ 	}
 */
 package rpc
 
+import (
+	"context"
+	"crypto/ed25519"
+	"time"
+)
+
 // Register application in RPC
 func Register(name string, uuid string, token string) (*RPC, error) {
 
@@ -49,16 +155,32 @@ func Register(name string, uuid string, token string) (*RPC, error) {
 	rpc.token = token
 
 	rpc.connect = make(chan bool)
-	rpc.reconnect = make(chan bool)
-	rpc.connected = make(chan bool)
+	rpc.reconnect = make(chan error)
+	rpc.connected = make(chan bool, 1)
 
 	rpc.limit = 1
+	rpc.confirmTimeout = 10 * time.Second
+	rpc.logger = nopLogger{}
+	rpc.policy = DefaultReconnectPolicy()
+
+	rpc.codec = JSONCodec{}
+	rpc.codecs = make(map[string]Codec)
+	for _, c := range []Codec{JSONCodec{}, GobCodec{}, ProtobufCodec{}, MsgpackCodec{}, BinaryCodec{}} {
+		rpc.codecs[c.ContentType()] = c
+	}
 
-	rpc.done = make(chan error)
 	rpc.error = make(chan error)
 
-	rpc.handlers = make(map[string]Handler)
-	rpc.upstreams = make(map[string]Upstream)
+	rpc.handlers = make(map[string]route)
+	rpc.upstreams = make(map[string]route)
+	rpc.pending = make(map[string]waiter)
+	rpc.streams = make(map[string]*StreamReader)
+	rpc.trust = make(map[string]trusted)
+	rpc.retries = make(map[string]RetryPolicy)
+	rpc.expirations = make(map[string]time.Duration)
+
+	// root context for handlers, cancelled on shutdown
+	rpc.ctx, rpc.cancel = context.WithCancel(context.Background())
 	return &rpc, nil
 }
 
@@ -67,17 +189,111 @@ func (r *RPC) SetURI(uri string) {
 	r.uri = uri
 }
 
+// SetTransport - set broker transport, AMQP transport connected by URI is used by default
+func (r *RPC) SetTransport(t Transport) {
+	r.transport = t
+}
+
+// SetSigningKey - set shared secret to sign messages with HMAC-SHA256,
+// messages with missing or invalid signature are rejected with SignatureError
+func (r *RPC) SetSigningKey(key []byte) {
+	r.key = key
+}
+
+// SetIdentity - set application ed25519 private key to sign messages.
+// Application with identity accepts only messages signed by applications
+// from its trust store and does not check shared token
+func (r *RPC) SetIdentity(key ed25519.PrivateKey) {
+	r.identity = key
+	r.Trust(r.name, key.Public().(ed25519.PublicKey))
+}
+
+// PublicKey - get application public key to add into other applications trust stores
+func (r *RPC) PublicKey() ed25519.PublicKey {
+	if r.identity == nil {
+		return nil
+	}
+	return r.identity.Public().(ed25519.PublicKey)
+}
+
+// Trust - add application public key to trust store, application is allowed
+// to send messages only on its own name
+func (r *RPC) Trust(name string, key ed25519.PublicKey) {
+	r.mutex.Lock()
+	r.trust[name] = trusted{key: key}
+	r.mutex.Unlock()
+}
+
+// TrustProxy - add application public key to trust store, application is allowed
+// to send messages on behalf of other applications, for example from upstream with CallSigned
+func (r *RPC) TrustProxy(name string, key ed25519.PublicKey) {
+	r.mutex.Lock()
+	r.trust[name] = trusted{key: key, proxy: true}
+	r.mutex.Unlock()
+}
+
+// Untrust - remove application public key from trust store
+func (r *RPC) Untrust(name string) {
+	r.mutex.Lock()
+	delete(r.trust, name)
+	r.mutex.Unlock()
+}
+
+// SetCodec - set codec for sent messages, JSON is used by default
+func (r *RPC) SetCodec(c Codec) {
+	r.codecs[c.ContentType()] = c
+	r.codec = c
+}
+
+// RegisterCodec - register codec to decode received messages with its content type,
+// JSON, gob, protobuf and msgpack codecs are registered by default
+func (r *RPC) RegisterCodec(c Codec) {
+	r.codecs[c.ContentType()] = c
+}
+
+// Encode - encode handler response with codec of message handled with ctx
+func (r *RPC) Encode(ctx context.Context, v interface{}) ([]byte, error) {
+	c, err := r.codecFor(ContentType(ctx))
+	if err != nil {
+		return nil, err
+	}
+	return c.Marshal(v)
+}
+
+// Decode - decode message handled with ctx by its content type
+func (r *RPC) Decode(ctx context.Context, data []byte, v interface{}) error {
+	c, err := r.codecFor(ContentType(ctx))
+	if err != nil {
+		return err
+	}
+	return c.Unmarshal(data, v)
+}
+
+// SetLimit - set number of handlers running at once, it also limits unacknowledged
+// deliveries per consumer, handlers are not bounded when limit is not positive
 func (r *RPC) SetLimit(limit int) {
 	r.limit = limit
 }
 
+// SetConfirmTimeout - set how long Call waits for broker to confirm message,
+// ERRCONFIRMTIMEOUT is returned when confirm is not received in time
+func (r *RPC) SetConfirmTimeout(timeout time.Duration) {
+	r.confirmTimeout = timeout
+}
+
 // Start listening for incoming messages
 func (r *RPC) Listen() {
+	r.defaultTransport()
+	r.online.Store(true)
 	go r.listen()
-	r.online = true
+	if interval := r.presence.announcing(); interval > 0 {
+		go r.heartbeat(interval)
+	}
 	r.connect <- true
 }
 
+// Connected - channel signalled when RPC is connected to broker, signal is kept until
+// it is read and connect does not wait for it, use Health to check connection state
 func (r *RPC) Connected() chan bool {
 	return r.connected
 }
@@ -86,7 +302,18 @@ func (r *RPC) Cleanup() {
 	r.cleanup()
 }
 
+// Shutdown - stop consuming and wait for running handlers,
+// handler contexts are cancelled right away
 func (r *RPC) Shutdown() {
-	r.online = false
-	r.shutdown()
+	r.cancel()
+	r.ShutdownContext(context.Background())
+}
+
+// ShutdownContext - stop consuming on all queues and wait for running handlers
+// until ctx is done, then deliveries of unfinished handlers are requeued, their
+// contexts are cancelled and connection is closed. ctx error is returned when
+// handlers did not finish in time
+func (r *RPC) ShutdownContext(ctx context.Context) error {
+	r.online.Store(false)
+	return r.stop(ctx)
 }
@@ -19,11 +19,6 @@ func TestRegister(t *testing.T) {
 		t.Error("Register APP error", err)
 	}
 
-	defer func() {
-		r.cleanup()
-		r.shutdown()
-	}()
-
 	if r.name != name {
 		t.Error("Expected name: %s got %s", name, r.name)
 	}
@@ -42,10 +37,6 @@ func TestRegister(t *testing.T) {
 		t.Error("Expected uri: %s got %s", uri, r.uri)
 	}
 
-	r.Listen()
-	select {
-	case <-r.connected:
-		return
-	}
-
+	listenMemory(t, NewMemoryBroker(), r)
+	defer r.Shutdown()
 }
@@ -0,0 +1,165 @@
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+)
+
+// headerScheduleID - id of scheduled message used to find it in delay queue
+const headerScheduleID = "x-schedule-id"
+
+// scheduleResolution - delays are rounded up to resolution,
+// so messages scheduled close to each other share delay queue
+const scheduleResolution = 100 * time.Millisecond
+
+// schedule - delivery time of message sent with context and its id set by send
+type schedule struct {
+	at time.Time
+	id string
+}
+
+// CallAt - schedule message with delivery guarantee to be delivered at time,
+// returned id cancels scheduled message with CancelScheduled
+func (r *RPC) CallAt(at time.Time, d Destination, message interface{}) (string, error) {
+	return r.CallAtContext(context.Background(), at, d, message)
+}
+
+// CallAfter - schedule message with delivery guarantee to be delivered after delay
+func (r *RPC) CallAfter(delay time.Duration, d Destination, message interface{}) (string, error) {
+	return r.CallAtContext(context.Background(), time.Now().Add(delay), d, message)
+}
+
+// CallAtContext - schedule message with delivery guarantee to be delivered at time.
+// Message waits in delay queue declared per destination and delay, which passes it to
+// destination exchange once delay expired, so message is delivered no earlier than at.
+// Scheduled message does not expire and it is dropped when destination is not bound at
+// delivery time. Message scheduled at passed time is sent right away and can not be cancelled
+func (r *RPC) CallAtContext(ctx context.Context, at time.Time, d Destination, message interface{}) (string, error) {
+
+	msg, err := r.codec.Marshal(message)
+	if err != nil {
+		r.logger.Error("message encode failed", fieldDestination(d), fieldHandler(d.Handler), fieldErr(err))
+		return "", err
+	}
+
+	sc := &schedule{at: at}
+	ctx = context.WithValue(ctx, scheduleKey, sc)
+
+	if err := r.call(ctx, Sender{r.name, r.uuid}, d, Receiver{}, r.codec.ContentType(), msg); err != nil {
+		return "", err
+	}
+
+	return sc.id, nil
+}
+
+// CancelScheduled - remove scheduled message from delay queue before it is delivered,
+// ERRSCHEDULEDNOTFOUND is returned when message is already delivered
+func (r *RPC) CancelScheduled(id string) error {
+
+	parts := strings.SplitN(id, "/", 4)
+	if len(parts) != 4 {
+		return ERRSCHEDULEDNOTFOUND
+	}
+
+	key, exchange, bind := parts[0], parts[2], parts[3]
+	ms, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return ERRSCHEDULEDNOTFOUND
+	}
+
+	if r.transport == nil {
+		return ERRNOTCONNECTED
+	}
+
+	// delay queue is removed once unused, declare it again instead of failing to find it
+	queue := scheduleQueue(exchange, bind, ms)
+	if err := r.delayQueue(queue, exchange, bind, ms); err != nil {
+		return err
+	}
+
+	var found *Delivery
+
+	err = r.browse(queue, func(d Delivery) bool {
+		if v, _ := d.Headers[headerScheduleID].(string); v == key {
+			found = &d
+			return true
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+
+	if found == nil {
+		return ERRSCHEDULEDNOTFOUND
+	}
+
+	return found.Ack()
+}
+
+// delay routes scheduled message to delay queue of exchange and key, it returns
+// exchange and key unchanged when message is due already
+func (r *RPC) delay(sc *schedule, exchange, key string, msg *Publishing) (string, string, error) {
+
+	id := uuid.NewV4().String()
+
+	delay := time.Until(sc.at)
+	if delay <= 0 {
+		sc.id = id
+		return exchange, key, nil
+	}
+
+	res := int64(scheduleResolution / time.Millisecond)
+	ms := (delay.Milliseconds() + res - 1) / res * res
+
+	queue := scheduleQueue(exchange, key, ms)
+	if err := r.delayQueue(queue, exchange, key, ms); err != nil {
+		return exchange, key, err
+	}
+
+	// dead-lettering drops message expiration, so message expiration can not start at delivery
+	msg.Expiration = 0
+	msg.Timestamp = sc.at
+	msg.Headers[headerPublishedAt] = sc.at.UnixNano()
+	msg.Headers[headerScheduleID] = id
+
+	sc.id = strings.Join([]string{id, strconv.FormatInt(ms, 10), exchange, key}, "/")
+
+	return "", queue, nil
+}
+
+// scheduleQueue returns name of delay queue of scheduled messages to exchange with key
+func scheduleQueue(exchange, key string, ms int64) string {
+	return fmt.Sprintf("%s:%s:delay:%d", exchange, key, ms)
+}
+
+// delayQueue declares queue dead-lettering messages to exchange with key after ms milliseconds,
+// it is shared by scheduled messages and retries of failed messages
+func (r *RPC) delayQueue(queue, exchange, key string, ms int64) error {
+
+	if r.transport == nil {
+		return ERRNOTCONNECTED
+	}
+
+	_, err := r.transport.QueueDeclare(Queue{
+		Name:    queue,
+		Durable: true,
+		Args: map[string]interface{}{
+			"x-message-ttl":             ms,
+			"x-dead-letter-exchange":    exchange,
+			"x-dead-letter-routing-key": key,
+			// unused delay queue is removed once its last message expired
+			"x-expires": ms + time.Minute.Milliseconds(),
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("Queue Declare: %s", err)
+	}
+
+	return nil
+}
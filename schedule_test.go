@@ -0,0 +1,81 @@
+package rpc
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSchedule(t *testing.T) {
+
+	b := NewMemoryBroker()
+	received := make(chan string, 10)
+
+	r, _ := Register("test-schedule", "uuid", "token")
+	r.SetHandler("handler", func(s Sender, p []byte) error {
+		var m string
+		if err := r.codec.Unmarshal(p, &m); err != nil {
+			return err
+		}
+		received <- m
+		return nil
+	})
+	listenMemory(t, b, r)
+	defer r.Shutdown()
+
+	d := Destination{Name: "test-schedule", Handler: "handler"}
+
+	start := time.Now()
+
+	if _, err := r.CallAfter(time.Millisecond*150, d, "later"); err != nil {
+		t.Fatal("Call after failed:", err)
+	}
+
+	id, err := r.CallAfter(time.Millisecond*150, d, "cancelled")
+	if err != nil {
+		t.Fatal("Call after failed:", err)
+	}
+
+	// message scheduled at passed time is delivered right away
+	if _, err := r.CallAt(start.Add(-time.Second), d, "now"); err != nil {
+		t.Fatal("Call at failed:", err)
+	}
+
+	select {
+	case m := <-received:
+		if m != "now" {
+			t.Errorf("Expected message: %s got %s", "now", m)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No message received: failed")
+	}
+
+	if err := r.CancelScheduled(id); err != nil {
+		t.Fatal("Cancel failed:", err)
+	}
+
+	if err := r.CancelScheduled(id); err != ERRSCHEDULEDNOTFOUND {
+		t.Errorf("Expected error: %s got %v", ERRSCHEDULEDNOTFOUND, err)
+	}
+
+	select {
+	case m := <-received:
+		if m != "later" {
+			t.Errorf("Expected message: %s got %s", "later", m)
+		}
+		if elapsed := time.Since(start); elapsed < time.Millisecond*150 {
+			t.Errorf("Expected delivery after %s got %s", time.Millisecond*150, elapsed)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No message received: failed")
+	}
+
+	select {
+	case m := <-received:
+		t.Errorf("Unexpected delivery of cancelled message: %s", m)
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	if err := r.CancelScheduled("unknown"); err != ERRSCHEDULEDNOTFOUND {
+		t.Errorf("Expected error: %s got %v", ERRSCHEDULEDNOTFOUND, err)
+	}
+}
@@ -0,0 +1,390 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/satori/go.uuid"
+)
+
+// headerStream - marks reply carrying stream frame
+const headerStream = "x-stream"
+
+// stream frame flags
+const (
+	frameEnd byte = 1 << iota
+	frameError
+)
+
+// frameHeader - flags byte and big endian sequence number placed before frame data,
+// so frame header is signed within message envelope together with data
+const frameHeader = 1 + 8
+
+// streamWindow - frames received ahead of reader, further frames wait until Recv takes earlier ones
+const streamWindow = 64
+
+// StreamHandler - handler sending sequence of messages back to caller with stream,
+// stream is ended when handler returns and returned error terminates stream on caller side
+type StreamHandler func(context.Context, Sender, []byte, *Stream) error
+
+// Stream - sends messages of streaming handler back to caller in order
+type Stream struct {
+	r *RPC
+
+	to          Sender
+	reply       string
+	correlation string
+	contentType string
+
+	mutex  sync.Mutex
+	seq    uint64
+	closed bool
+}
+
+// StreamReader - receives messages sent by streaming handler in order they were sent
+type StreamReader struct {
+	r   *RPC
+	id  string
+	ctx context.Context
+
+	mutex       sync.Mutex
+	notify      chan struct{}
+	progress    chan struct{}
+	done        chan struct{}
+	once        sync.Once
+	frames      map[uint64]frame
+	next        uint64
+	contentType string
+
+	// final - reply of handler answering without stream
+	final *frame
+	// err - terminal error, io.EOF once stream ended
+	err error
+}
+
+type frame struct {
+	seq   uint64
+	end   bool
+	data  []byte
+	err   error
+	ctype string
+}
+
+// SetStreamHandler - set streaming handler routing, messages sent by handler to stream
+// are received by caller of Stream in order, interceptors wrap the whole handler call
+func (r *RPC) SetStreamHandler(h string, f StreamHandler, i ...Interceptor) {
+	r.handlers[h] = route{
+		invoke: func(ctx context.Context, m *Message) ([]byte, error) {
+			st, ok := ctx.Value(streamKey).(*Stream)
+			if !ok {
+				// message is sent without reply queue, nobody waits for stream
+				st = &Stream{r: r, closed: true}
+			}
+			return nil, f(ctx, m.Sender, m.Body, st)
+		},
+		interceptors: i,
+		stream:       true,
+	}
+}
+
+// Stream - send message with delivery guarantee to streaming handler and receive
+// messages it sends with returned reader, ctx bounds the whole stream
+func (r *RPC) Stream(ctx context.Context, d Destination, message interface{}) (*StreamReader, error) {
+
+	msg, err := r.codec.Marshal(message)
+	if err != nil {
+		r.logger.Error("message encode failed", fieldDestination(d), fieldHandler(d.Handler), fieldErr(err))
+		return nil, err
+	}
+
+	return r.stream(ctx, Sender{r.name, r.uuid}, d, r.codec.ContentType(), msg)
+}
+
+// StreamBinary - send binary message with delivery guarantee to streaming handler
+// and receive messages it sends with returned reader
+func (r *RPC) StreamBinary(ctx context.Context, d Destination, message []byte) (*StreamReader, error) {
+	return r.stream(ctx, Sender{r.name, r.uuid}, d, ContentTypeBinary, message)
+}
+
+// Send - encode message with codec of handled message and send it to caller
+func (st *Stream) Send(v interface{}) error {
+
+	c, err := st.r.codecFor(st.contentType)
+	if err != nil {
+		return err
+	}
+
+	data, err := c.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return st.SendBinary(data)
+}
+
+// SendBinary - send binary message to caller
+func (st *Stream) SendBinary(data []byte) error {
+	return st.send(0, data)
+}
+
+// Recv - wait for next message of stream, io.EOF is returned once stream ended
+// and error returned by handler when stream is terminated by it
+func (s *StreamReader) Recv() ([]byte, error) {
+
+	for {
+		s.mutex.Lock()
+
+		if s.err != nil {
+			err := s.err
+			s.mutex.Unlock()
+			return nil, err
+		}
+
+		f, ok := s.frames[s.next]
+		if ok {
+			delete(s.frames, s.next)
+			s.next++
+			select {
+			case s.progress <- struct{}{}:
+			default:
+			}
+		} else if s.final != nil {
+			f, ok = *s.final, true
+			s.final = nil
+		}
+
+		if ok {
+			s.contentType = f.ctype
+			if f.end {
+				s.err = io.EOF
+				if f.err != nil {
+					s.err = f.err
+				}
+			}
+		}
+
+		err := s.err
+		s.mutex.Unlock()
+
+		if ok && f.end {
+			s.Close()
+			// data of single reply is returned before stream end is reported
+			if len(f.data) == 0 {
+				return nil, err
+			}
+		}
+
+		if ok {
+			return f.data, nil
+		}
+
+		select {
+		case <-s.notify:
+		case <-s.ctx.Done():
+			s.Close()
+			return nil, s.ctx.Err()
+		}
+	}
+}
+
+// RecvDecode - wait for next message of stream and decode it into v with codec
+// matching message content type, it returns the same errors as Recv
+func (s *StreamReader) RecvDecode(v interface{}) error {
+
+	data, err := s.Recv()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	ct := s.contentType
+	s.mutex.Unlock()
+
+	c, err := s.r.codecFor(ct)
+	if err != nil {
+		return err
+	}
+
+	return c.Unmarshal(data, v)
+}
+
+// Close - stop receiving stream, messages sent by handler afterwards are dropped
+func (s *StreamReader) Close() {
+
+	s.r.mutex.Lock()
+	delete(s.r.streams, s.id)
+	s.r.mutex.Unlock()
+
+	s.mutex.Lock()
+	if s.err == nil {
+		s.err = ERRSTREAMCLOSED
+	}
+	s.frames = nil
+	s.mutex.Unlock()
+
+	s.once.Do(func() { close(s.done) })
+}
+
+// stream publishes message and registers reader for frames replied with its correlation id
+func (r *RPC) stream(ctx context.Context, s Sender, d Destination, contentType string, data []byte) (*StreamReader, error) {
+
+	id := uuid.NewV4().String()
+
+	sr := newStreamReader(r, id, ctx)
+
+	r.mutex.Lock()
+	r.streams[id] = sr
+	r.mutex.Unlock()
+
+	if err := r.publish(ctx, true, s, d, Receiver{}, contentType, data, id); err != nil {
+		sr.Close()
+		return nil, err
+	}
+
+	return sr, nil
+}
+
+// newStreamReader returns reader of stream with correlation id
+func newStreamReader(r *RPC, id string, ctx context.Context) *StreamReader {
+	return &StreamReader{
+		r:        r,
+		id:       id,
+		ctx:      ctx,
+		notify:   make(chan struct{}, 1),
+		progress: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		frames:   make(map[uint64]frame),
+	}
+}
+
+// newStream returns stream replying to caller of delivery
+func (r *RPC) newStream(d Delivery, s Sender) *Stream {
+	return &Stream{
+		r:           r,
+		to:          s,
+		reply:       d.ReplyTo,
+		correlation: d.CorrelationID,
+		contentType: d.ContentType,
+		closed:      d.ReplyTo == "",
+	}
+}
+
+// end sends end of stream frame, it terminates stream on caller side with err
+func (st *Stream) end(err error) error {
+	if err != nil {
+		return st.send(frameEnd|frameError, []byte(err.Error()))
+	}
+	return st.send(frameEnd, nil)
+}
+
+// send publishes frame with the next sequence number to caller reply queue,
+// frames may be published with different channels, so caller orders them by sequence
+func (st *Stream) send(flags byte, data []byte) error {
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.closed {
+		if st.reply == "" {
+			return ERRNOSTREAM
+		}
+		return ERRSTREAMCLOSED
+	}
+
+	f := make([]byte, frameHeader, frameHeader+len(data))
+	f[0] = flags
+	binary.BigEndian.PutUint64(f[1:frameHeader], st.seq)
+	f = append(f, data...)
+
+	body, err := st.r.encode(Sender{st.r.name, st.r.uuid}, Destination{Name: st.to.Name, UUID: st.to.UUID}, Receiver{}, f)
+	if err != nil {
+		return err
+	}
+
+	msg := Publishing{
+		ContentType:   st.contentType,
+		CorrelationID: st.correlation,
+		Headers:       st.r.signed(map[string]interface{}{headerStream: true}),
+		Body:          body,
+	}
+
+	// frames are sent even when handler context is cancelled by shutdown
+	if err := st.r.transport.Publish(context.Background(), "", st.reply, msg); err != nil {
+		return fmt.Errorf("Stream Publish: %s", err)
+	}
+
+	st.seq++
+	if flags&frameEnd != 0 {
+		st.closed = true
+	}
+
+	return nil
+}
+
+// push passes replied delivery to reader, frames are reordered by sequence number
+// and frames already received, for example sent again by retried handler, are dropped.
+// Frames beyond window block reply queue until reader catches up, is closed or ctx is done
+func (s *StreamReader) push(d Delivery, data []byte) {
+
+	s.mutex.Lock()
+
+	if s.err != nil {
+		s.mutex.Unlock()
+		return
+	}
+
+	if streamed, _ := d.Headers[headerStream].(bool); !streamed {
+		// handler without stream answered with single reply
+		f := frame{end: true, data: data, ctype: d.ContentType}
+		if e, ok := d.Headers["error"].(string); ok {
+			f.err = errors.New(e)
+		}
+		s.final = &f
+	} else if f, ok := parseFrame(data); ok {
+		for s.err == nil && f.seq >= s.next+streamWindow {
+			s.mutex.Unlock()
+			select {
+			case <-s.progress:
+			case <-s.done:
+			case <-s.ctx.Done():
+				s.Close()
+			}
+			s.mutex.Lock()
+		}
+		if s.err == nil && f.seq >= s.next {
+			f.ctype = d.ContentType
+			s.frames[f.seq] = f
+		}
+	}
+
+	s.mutex.Unlock()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func parseFrame(data []byte) (frame, bool) {
+
+	if len(data) < frameHeader {
+		return frame{}, false
+	}
+
+	f := frame{
+		seq:  binary.BigEndian.Uint64(data[1:frameHeader]),
+		end:  data[0]&frameEnd != 0,
+		data: data[frameHeader:],
+	}
+
+	if data[0]&frameError != 0 {
+		f.err = errors.New(string(f.data))
+		f.data = nil
+	}
+
+	return f, true
+}
@@ -0,0 +1,193 @@
+package rpc
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestStream(t *testing.T) {
+
+	b := NewMemoryBroker()
+
+	r, _ := Register("test-stream", "uuid", "token")
+	r.SetStreamHandler("tail", func(ctx context.Context, s Sender, p []byte, st *Stream) error {
+		var n int
+		if err := r.Decode(ctx, p, &n); err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			if err := st.Send(struct{ Line int }{i}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	r.SetStreamHandler("fail", func(ctx context.Context, s Sender, p []byte, st *Stream) error {
+		st.SendBinary([]byte("first"))
+		return ERRINVALIDLENGTH
+	})
+	r.SetReplyHandler("reply", func(s Sender, p []byte) ([]byte, error) {
+		return []byte("single"), nil
+	})
+	listenMemory(t, b, r)
+	defer r.Shutdown()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	sr, err := r.Stream(ctx, Destination{Name: "test-stream", Handler: "tail"}, 5)
+	if err != nil {
+		t.Fatal("Stream failed:", err)
+	}
+
+	for i := 0; i < 5; i++ {
+		out := struct{ Line int }{}
+		if err := sr.RecvDecode(&out); err != nil || out.Line != i {
+			t.Fatalf("Expected line: %d got %d (%v)", i, out.Line, err)
+		}
+	}
+
+	if _, err := sr.Recv(); err != io.EOF {
+		t.Errorf("Expected error: %s got %v", io.EOF, err)
+	}
+
+	sr, err = r.StreamBinary(ctx, Destination{Name: "test-stream", Handler: "fail"}, []byte{})
+	if err != nil {
+		t.Fatal("Stream failed:", err)
+	}
+
+	if data, err := sr.Recv(); err != nil || string(data) != "first" {
+		t.Errorf("Expected message: %s got %s (%v)", "first", data, err)
+	}
+
+	if _, err := sr.Recv(); err == nil || err.Error() != ERRINVALIDLENGTH.Error() {
+		t.Errorf("Expected error: %s got %v", ERRINVALIDLENGTH, err)
+	}
+
+	// handler without stream terminates stream with its single reply
+	sr, err = r.StreamBinary(ctx, Destination{Name: "test-stream", Handler: "reply"}, []byte{})
+	if err != nil {
+		t.Fatal("Stream failed:", err)
+	}
+
+	if data, err := sr.Recv(); err != nil || string(data) != "single" {
+		t.Errorf("Expected message: %s got %s (%v)", "single", data, err)
+	}
+
+	if _, err := sr.Recv(); err != io.EOF {
+		t.Errorf("Expected error: %s got %v", io.EOF, err)
+	}
+
+	r.mutex.Lock()
+	n := len(r.streams)
+	r.mutex.Unlock()
+
+	if n != 0 {
+		t.Errorf("Expected ended streams removed, got %d", n)
+	}
+}
+
+func TestStreamOrder(t *testing.T) {
+
+	r, _ := Register("test-stream-order", "uuid", "token")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	sr := newStreamReader(r, "", ctx)
+
+	push := func(flags byte, seq byte, data string) {
+		f := append([]byte{flags, 0, 0, 0, 0, 0, 0, 0, seq}, data...)
+		sr.push(Delivery{Publishing: Publishing{Headers: map[string]interface{}{headerStream: true}}}, f)
+	}
+
+	// frames published with different channels arrive out of order and retried handler sends them again
+	push(frameEnd, 3, "")
+	push(0, 1, "b")
+	push(0, 0, "a")
+	push(0, 2, "c")
+
+	for _, want := range []string{"a", "b"} {
+		if data, err := sr.Recv(); err != nil || string(data) != want {
+			t.Fatalf("Expected message: %s got %s (%v)", want, data, err)
+		}
+	}
+
+	push(0, 0, "a")
+
+	if data, err := sr.Recv(); err != nil || string(data) != "c" {
+		t.Fatalf("Expected message: %s got %s (%v)", "c", data, err)
+	}
+
+	if _, err := sr.Recv(); err != io.EOF {
+		t.Errorf("Expected error: %s got %v", io.EOF, err)
+	}
+}
+
+func TestStreamWindow(t *testing.T) {
+
+	r, _ := Register("test-stream-window", "uuid", "token")
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	sr := newStreamReader(r, "", ctx)
+
+	push := func(seq uint64) {
+		f := make([]byte, frameHeader)
+		binary.BigEndian.PutUint64(f[1:], seq)
+		sr.push(Delivery{Publishing: Publishing{Headers: map[string]interface{}{headerStream: true}}}, append(f, 'x'))
+	}
+
+	for seq := uint64(0); seq < streamWindow; seq++ {
+		push(seq)
+	}
+
+	pushed := make(chan struct{})
+	go func() {
+		push(streamWindow)
+		close(pushed)
+	}()
+
+	select {
+	case <-pushed:
+		t.Fatal("Expected frame beyond window waiting for reader")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, err := sr.Recv(); err != nil {
+		t.Fatal("Recv failed:", err)
+	}
+
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		t.Fatal("Expected frame pushed after reader caught up")
+	}
+
+	sr.mutex.Lock()
+	n := len(sr.frames)
+	sr.mutex.Unlock()
+
+	if n != streamWindow {
+		t.Errorf("Expected %d frames buffered, got %d", streamWindow, n)
+	}
+
+	// closed reader releases reply queue waiting for frames it will never take
+	released := make(chan struct{})
+	go func() {
+		push(2 * streamWindow)
+		close(released)
+	}()
+
+	sr.Close()
+
+	select {
+	case <-released:
+	case <-time.After(time.Second):
+		t.Fatal("Expected closed reader releasing frame beyond window")
+	}
+}
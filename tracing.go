@@ -0,0 +1,110 @@
+package rpc
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const tracerName = "github.com/lastbackend/rpc"
+
+// headerCarrier passes W3C trace context in message headers
+type headerCarrier map[string]interface{}
+
+func (c headerCarrier) Get(key string) string {
+	v, _ := c[key].(string)
+	return v
+}
+
+func (c headerCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headerCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for k := range c {
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+// SetTracerProvider - enable tracing, trace context is passed with messages
+// in W3C format and every handler and upstream call runs in consumer span
+func (r *RPC) SetTracerProvider(tp trace.TracerProvider) {
+	r.tracer = tp.Tracer(tracerName)
+	r.propagator = propagation.TraceContext{}
+}
+
+// inject starts producer span for published message and puts its context into headers
+func (r *RPC) inject(ctx context.Context, m *Message, headers map[string]interface{}) func(error) {
+
+	if r.tracer == nil {
+		return func(error) {}
+	}
+
+	ctx, span := r.tracer.Start(ctx, "rpc.publish "+m.Destination.Name,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attributes(m)...),
+	)
+
+	r.propagator.Inject(ctx, headerCarrier(headers))
+
+	return func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+// extract starts consumer span for handler with trace context received in message headers
+func (r *RPC) extract(ctx context.Context, handler string, m *Message, d Delivery) (context.Context, func(error)) {
+
+	if r.tracer == nil {
+		return ctx, func(error) {}
+	}
+
+	ctx = r.propagator.Extract(ctx, headerCarrier(d.Headers))
+
+	attrs := append(attributes(m),
+		attribute.String("rpc.handler", handler),
+		attribute.Int64("rpc.delivery_tag", int64(d.DeliveryTag)),
+	)
+
+	ctx, span := r.tracer.Start(ctx, "rpc.handle "+handler,
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attrs...),
+	)
+
+	return ctx, func(err error) {
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	}
+}
+
+func attributes(m *Message) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("rpc.sender.name", m.Sender.Name),
+		attribute.String("rpc.sender.uuid", m.Sender.UUID),
+		attribute.String("rpc.destination.name", m.Destination.Name),
+		attribute.String("rpc.destination.uuid", m.Destination.UUID),
+		attribute.String("rpc.destination.handler", m.Destination.Handler),
+		attribute.Bool("rpc.call", m.Call),
+	}
+
+	if m.Receiver.Name != "" {
+		attrs = append(attrs,
+			attribute.String("rpc.receiver.name", m.Receiver.Name),
+			attribute.String("rpc.receiver.handler", m.Receiver.Handler),
+		)
+	}
+
+	return attrs
+}
@@ -0,0 +1,102 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTracingProxyCall(t *testing.T) {
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	b := NewMemoryBroker()
+	end := make(chan trace.SpanContext)
+
+	proxy, _ := Register("test-tracing-proxy", "proxy", "token")
+	proxy.SetTracerProvider(tp)
+	proxy.SetUpstreamContext("upstream", func(ctx context.Context, s Sender, d Destination, p []byte) error {
+		return proxy.CallSignedBinaryContext(ctx, s, d, p)
+	})
+	listenMemory(t, b, proxy)
+	defer proxy.Shutdown()
+
+	dest, _ := Register("test-tracing-dest", "dest", "token")
+	dest.SetTracerProvider(tp)
+	dest.SetHandlerContext("handler", func(ctx context.Context, s Sender, p []byte) error {
+		end <- trace.SpanContextFromContext(ctx)
+		return nil
+	})
+	listenMemory(t, b, dest)
+	defer dest.Shutdown()
+
+	sender, _ := Register("test-tracing-sender", "sender", "token")
+	sender.SetTracerProvider(tp)
+	listenMemory(t, b, sender)
+	defer sender.Shutdown()
+
+	ctx, root := tp.Tracer("test").Start(context.Background(), "root")
+
+	d := Destination{Name: "test-tracing-dest", Handler: "handler"}
+	p := Receiver{Name: "test-tracing-proxy", Handler: "upstream"}
+
+	if err := sender.ProxyCallBinaryContext(ctx, d, p, []byte("{}")); err != nil {
+		t.Error("Proxy call failed:", err)
+	}
+	root.End()
+
+	select {
+	case sc := <-end:
+		if sc.TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("Expected trace: %s got %s", root.SpanContext().TraceID(), sc.TraceID())
+		}
+	case <-time.After(time.Second):
+		t.Fatal("No message received: failed")
+	}
+
+	// root, sender publish, proxy upstream, proxy publish and destination handler spans
+	deadline := time.Now().Add(time.Second)
+	for len(recorder.Ended()) < 5 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 5 {
+		t.Fatalf("Expected spans: %d got %d", 5, len(spans))
+	}
+
+	for _, s := range spans {
+		if s.SpanContext().TraceID() != root.SpanContext().TraceID() {
+			t.Errorf("Span %s is not in root trace", s.Name())
+		}
+	}
+}
+
+func TestTracingPublishFailed(t *testing.T) {
+
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	// reply queue is declared once RPC is subscribed
+	r, _ := Register("test-tracing-failed", "uuid", "token")
+	r.SetTracerProvider(tp)
+	r.SetTransport(NewMemoryTransport())
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	d := Destination{Name: "test-tracing-failed", Handler: "handler"}
+	if _, err := r.RequestBinary(ctx, d, []byte("{}")); !errors.Is(err, ERRNOREPLYQUEUE) {
+		t.Errorf("Expected error: %s got %v", ERRNOREPLYQUEUE, err)
+	}
+
+	if started, ended := len(recorder.Started()), len(recorder.Ended()); started != 1 || ended != 1 {
+		t.Errorf("Expected started and ended spans: %d got %d and %d", 1, started, ended)
+	}
+}
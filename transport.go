@@ -0,0 +1,109 @@
+package rpc
+
+import (
+	"context"
+	"time"
+)
+
+// Transport - message broker connection used by RPC.
+// RPC routes messages with direct and topic exchanges bound to queues,
+// so any broker providing these semantics can be used as transport.
+type Transport interface {
+	// Dial opens connection to broker, it is called again after connection is lost
+	Dial() error
+	// NotifyClose returns channel receiving connection close reason, nil on graceful close
+	NotifyClose() <-chan error
+	// Close closes connection to broker
+	Close() error
+
+	// ExchangeDeclare declares durable exchange of kind "direct" or "topic"
+	ExchangeDeclare(name, kind string) error
+	// ExchangeDelete removes exchange if it is not used
+	ExchangeDelete(name string) error
+	// QueueDeclare declares queue and returns its name, server generates name if it is empty,
+	// queue with "x-max-priority" argument delivers messages with higher priority first
+	QueueDeclare(q Queue) (string, error)
+	// QueueBind routes messages published to exchange with routing key to queue
+	QueueBind(queue, key, exchange string) error
+	// QueueDelete removes queue if it is empty
+	QueueDelete(name string) error
+
+	// Publish sends message to exchange with routing key,
+	// empty exchange routes message directly to the queue named by key
+	Publish(ctx context.Context, exchange, key string, msg Publishing) error
+	// PublishConfirm sends message like Publish and blocks until broker confirms it,
+	// ERRPUBLISHNACK is returned when broker rejects message and ERRNOROUTE
+	// when mandatory message is returned as unroutable
+	PublishConfirm(ctx context.Context, exchange, key string, msg Publishing) error
+	// NotifyReturn returns channel receiving mandatory messages published with Publish
+	// which broker could not route, it is the same channel for transport lifetime
+	NotifyReturn() <-chan Return
+	// Consume starts delivering messages from queue, no more than limit unacknowledged at once
+	Consume(queue, consumer string, limit int) (<-chan Delivery, error)
+	// Cancel stops consumer and closes its deliveries channel
+	Cancel(consumer string) error
+	// Get takes single message from queue without consumer, it reports false when queue is empty
+	Get(queue string) (Delivery, bool, error)
+}
+
+// Queue - queue declaration options
+type Queue struct {
+	Name       string
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	Args       map[string]interface{}
+}
+
+// Publishing - message sent to transport
+type Publishing struct {
+	ContentType   string
+	CorrelationID string
+	ReplyTo       string
+	Headers       map[string]interface{}
+	Body          []byte
+
+	// Mandatory - return message to publisher when it is not routed to any queue
+	Mandatory bool
+	// Priority - message priority in priority queue, higher priority messages are delivered first
+	Priority uint8
+	// Expiration - message is discarded by broker when it is not consumed in time,
+	// dead-lettered message loses its expiration
+	Expiration time.Duration
+	// Timestamp - time message was published at
+	Timestamp time.Time
+}
+
+// Return - mandatory message returned by broker as unroutable
+type Return struct {
+	Publishing
+
+	Exchange string
+	Key      string
+	Reason   string
+}
+
+// Delivery - message received from transport
+type Delivery struct {
+	Publishing
+
+	ConsumerTag  string
+	DeliveryTag  uint64
+	Acknowledger Acknowledger
+}
+
+// Acknowledger - acknowledges deliveries by tag on transport side
+type Acknowledger interface {
+	Ack(tag uint64) error
+	Nack(tag uint64, requeue bool) error
+}
+
+// Ack - acknowledge delivery
+func (d Delivery) Ack() error {
+	return d.Acknowledger.Ack(d.DeliveryTag)
+}
+
+// Nack - reject delivery, requeued delivery will be consumed again
+func (d Delivery) Nack(requeue bool) error {
+	return d.Acknowledger.Nack(d.DeliveryTag, requeue)
+}
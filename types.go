@@ -1,47 +1,119 @@
 package rpc
 
-import "github.com/streadway/amqp"
+import (
+	"context"
+	"crypto/ed25519"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
 
 type RPC struct {
-	uri  string
-	conn *amqp.Connection
+	uri       string
+	transport Transport
 
 	name  string
 	uuid  string
 	token string
+	key   []byte
+
+	identity ed25519.PrivateKey
+	trust    map[string]trusted
 
-	limit int
+	limit          int
+	confirmTimeout time.Duration
+	maxPriority    uint8
 
+	codec  Codec
+	codecs map[string]Codec
+
+	policy    ReconnectPolicy
 	connect   chan bool
-	reconnect chan bool
+	reconnect chan error
 	connected chan bool
 
-	done  chan error
 	error chan error
 
-	handlers  map[string]Handler
-	upstreams map[string]Upstream
+	handlers  map[string]route
+	upstreams map[string]route
+
+	interceptors       []Interceptor
+	clientInterceptors []ClientInterceptor
+
+	logger     Logger
+	logPayload bool
+
+	metrics *Metrics
+
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+
+	mutex   sync.Mutex
+	pending map[string]waiter
+	streams map[string]*StreamReader
+	pool    *dispatcher
+	status  status
+
+	returns       sync.Once
+	returnHandler ReturnHandler
+
+	retries map[string]RetryPolicy
+
+	expirations    map[string]time.Duration
+	expiredHandler ExpiredHandler
+
+	presence presence
 
-	channels  channels
 	exchanges exchanges
 	queues    queues
 
-	online bool
-}
+	ctx    context.Context
+	cancel context.CancelFunc
 
-type channels struct {
-	common *amqp.Channel
-	direct *amqp.Channel
-	topic  *amqp.Channel
+	online atomic.Bool
 }
+
 type exchanges struct {
-	direct string
-	topic  string
+	direct     string
+	topic      string
+	deadLetter string
 }
 type queues struct {
-	common string
-	direct string
-	topic  string
+	common     string
+	direct     string
+	topic      string
+	reply      string
+	deadLetter string
+	presence   string
+}
+
+type trusted struct {
+	key   ed25519.PublicKey
+	proxy bool
+}
+
+// waiter - caller waiting for replies, done is closed once caller stops waiting
+type waiter struct {
+	replies chan reply
+	done    chan struct{}
+}
+
+type reply struct {
+	sender      Sender
+	contentType string
+	data        []byte
+	err         error
+}
+
+// Reply - handler response of single instance to broadcast request
+type Reply struct {
+	Sender      Sender
+	ContentType string
+	Data        []byte
+	Err         error
 }
 
 type Sender struct {
@@ -66,3 +138,13 @@ type Receiver struct {
 type Handler func(Sender, []byte) error
 
 type Upstream func(Sender, Destination, []byte) error
+
+type ReplyHandler func(Sender, []byte) ([]byte, error)
+
+type HandlerContext func(context.Context, Sender, []byte) error
+
+type UpstreamContext func(context.Context, Sender, Destination, []byte) error
+
+type ReplyHandlerContext func(context.Context, Sender, []byte) ([]byte, error)
+
+type ReturnHandler func(Destination, []byte)
@@ -1,8 +1,11 @@
 package rpc
 
 import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
 	"errors"
-	log "github.com/Sirupsen/logrus"
+	"fmt"
 	"strconv"
 	"strings"
 )
@@ -10,8 +13,55 @@ import (
 var (
 	ERRINVALIDLENGTH = errors.New("Invalid length of message field")
 	ERRINVALIDTOKEN  = errors.New("Invalid authentication token")
+
+	ERRHANDLERNOTFOUND  = errors.New("Handler not found")
+	ERRUPSTREAMNOTFOUND = errors.New("Upstream not found")
+	ERRNOREPLYQUEUE     = errors.New("Reply queue is not declared")
+	ERRNOTCONNECTED     = errors.New("Transport is not connected")
+	ERRUNKNOWNCODEC     = errors.New("Codec is not registered for content type")
+
+	ERRPUBLISHNACK    = errors.New("Message is not confirmed by broker")
+	ERRCONFIRMTIMEOUT = errors.New("Message confirm timeout")
+	ERRNOROUTE        = errors.New("Message is not routed to any queue")
+
+	ERRDEADLETTERNOTFOUND = errors.New("Dead letter not found")
+
+	ERRNOSTREAM     = errors.New("Message sender does not wait for stream")
+	ERRSTREAMCLOSED = errors.New("Stream is closed")
+
+	ERRMESSAGEEXPIRED = errors.New("Message expired before handling")
+
+	ERRSCHEDULEDNOTFOUND = errors.New("Scheduled message not found")
 )
 
+// headerSignature - flags of signature sections placed between receiver section and payload,
+// header keeps envelope of unsigned message unchanged for applications not signing messages
+const headerSignature = "x-signature"
+
+// envelope flags - signature sections present in envelope
+const (
+	envelopeHMAC int64 = 1 << iota
+	envelopeIdentity
+)
+
+// SignatureError - message envelope signature does not match its content,
+// or message is signed by application missing in trust store
+type SignatureError struct {
+	Sender      Sender
+	Destination Destination
+	Signer      Sender
+}
+
+func (e *SignatureError) Error() string {
+	if e.Signer.Name != "" && e.Signer != e.Sender {
+		return fmt.Sprintf("Invalid message signature from %s:%s signed by %s:%s to %s:%s",
+			e.Sender.Name, e.Sender.UUID, e.Signer.Name, e.Signer.UUID, e.Destination.Name, e.Destination.UUID)
+	}
+	return fmt.Sprintf("Invalid message signature from %s:%s to %s:%s", e.Sender.Name, e.Sender.UUID, e.Destination.Name, e.Destination.UUID)
+}
+
+// Sign - serialize sender into message envelope,
+// envelope is signed with HMAC-SHA256 when RPC signing key is set
 func (s *Sender) Sign() ([]byte, error) {
 
 	var body []byte
@@ -35,6 +85,7 @@ func (s *Sender) Sign() ([]byte, error) {
 	return body, nil
 }
 
+// Sign - serialize receiver into message envelope
 func (p *Receiver) Sign() ([]byte, error) {
 
 	var body []byte
@@ -61,6 +112,7 @@ func (p *Receiver) Sign() ([]byte, error) {
 	return body, nil
 }
 
+// Sign - serialize destination into message envelope
 func (d *Destination) Sign() ([]byte, error) {
 
 	var body []byte
@@ -117,12 +169,84 @@ func (r *RPC) encode(s Sender, d Destination, p Receiver, data []byte) ([]byte,
 		return body, err
 	}
 	body = append(body, receiver[:]...)
+
+	// sign envelope with application identity, signer is verified by receiver trust store
+	if r.identity != nil {
+		signer := Sender{r.name, r.uuid}
+		sign, err := signer.Sign()
+		if err != nil {
+			return body, err
+		}
+		body = append(body, sign[:]...)
+		body = append(body, ed25519.Sign(r.identity, append(body[:len(body):len(body)], data...))...)
+	}
+
+	// sign envelope header with payload and place signature before payload
+	if r.key != nil {
+		body = append(body, r.mac(body, data)...)
+	}
+
 	body = append(body, data[:]...)
 
 	return body, nil
 }
 
-func (r *RPC) decode(data []byte) (Sender, Destination, Receiver, []byte, error) {
+// signature returns flags of signature sections added to envelope by encode
+func (r *RPC) signature() int64 {
+	var flags int64
+	if r.key != nil {
+		flags |= envelopeHMAC
+	}
+	if r.identity != nil {
+		flags |= envelopeIdentity
+	}
+	return flags
+}
+
+// signed marks message headers with signature sections of envelope encoded by RPC,
+// headers are created when message has none. Marker is not signed, receiver with key
+// or identity rejects message without signature anyway
+func (r *RPC) signed(headers map[string]interface{}) map[string]interface{} {
+	flags := r.signature()
+	if flags == 0 {
+		return headers
+	}
+	if headers == nil {
+		headers = make(map[string]interface{})
+	}
+	headers[headerSignature] = flags
+	return headers
+}
+
+// mac returns HMAC-SHA256 of envelope header and payload
+func (r *RPC) mac(header, data []byte) []byte {
+	m := hmac.New(sha256.New, r.key)
+	m.Write(header)
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+// verify checks identity signature with signer public key from trust store,
+// message signer should be its sender or trusted proxy
+func (r *RPC) verify(s, signer Sender, header, sign, data []byte) bool {
+
+	r.mutex.Lock()
+	t, ok := r.trust[signer.Name]
+	r.mutex.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	if signer.Name != s.Name && !t.proxy {
+		return false
+	}
+
+	return ed25519.Verify(t.key, append(header[:len(header):len(header)], data...), sign)
+}
+
+// decode parses envelope, headers of message tell signature sections present in envelope
+func (r *RPC) decode(data []byte, headers map[string]interface{}) (Sender, Destination, Receiver, []byte, error) {
 
 	s := Sender{}
 	d := Destination{}
@@ -132,30 +256,47 @@ func (r *RPC) decode(data []byte) (Sender, Destination, Receiver, []byte, error)
 		return s, d, p, []byte{}, errors.New("Body is empty")
 	}
 
-	tc, err := r.parseInt(data[0:2], 2)
+	raw := data
+
+	tc, err := r.field(data, 0, 2, 2)
 	if err != nil {
-		log.Error("Parse message error:", err)
 		return s, d, p, []byte{}, err
 	}
 
 	var token = string(data[2:tc])
 
-	if token != r.token {
+	// applications with identity are authenticated by signature instead of shared token
+	if r.identity == nil && token != r.token {
 		return s, d, p, []byte{}, ERRINVALIDTOKEN
 	}
 
 	data = data[tc:]
-	snl, _ := r.parseInt(data[0:3], 6)
-	sul, _ := r.parseInt(data[3:6], snl)
+	snl, err := r.field(data, 0, 3, 6)
+	if err != nil {
+		return s, d, p, []byte{}, err
+	}
+	sul, err := r.field(data, 3, 3, snl)
+	if err != nil {
+		return s, d, p, []byte{}, err
+	}
 
 	s.Name = string(data[6:snl])
 	s.UUID = string(data[snl:sul])
 
 	data = data[sul:]
 
-	dnl, _ := r.parseInt(data[0:3], 9)
-	dul, _ := r.parseInt(data[3:6], dnl)
-	dhl, _ := r.parseInt(data[6:9], dul)
+	dnl, err := r.field(data, 0, 3, 9)
+	if err != nil {
+		return s, d, p, []byte{}, err
+	}
+	dul, err := r.field(data, 3, 3, dnl)
+	if err != nil {
+		return s, d, p, []byte{}, err
+	}
+	dhl, err := r.field(data, 6, 3, dul)
+	if err != nil {
+		return s, d, p, []byte{}, err
+	}
 
 	if dnl > 9 {
 		d.Name = string(data[9:dnl])
@@ -170,9 +311,18 @@ func (r *RPC) decode(data []byte) (Sender, Destination, Receiver, []byte, error)
 
 	data = data[dhl:]
 
-	pnl, _ := r.parseInt(data[0:3], 9)
-	pul, _ := r.parseInt(data[3:6], pnl)
-	phl, _ := r.parseInt(data[6:9], pul)
+	pnl, err := r.field(data, 0, 3, 9)
+	if err != nil {
+		return s, d, p, []byte{}, err
+	}
+	pul, err := r.field(data, 3, 3, pnl)
+	if err != nil {
+		return s, d, p, []byte{}, err
+	}
+	phl, err := r.field(data, 6, 3, pul)
+	if err != nil {
+		return s, d, p, []byte{}, err
+	}
 
 	if pnl > 9 {
 		p.Name = string(data[9:pnl])
@@ -185,9 +335,79 @@ func (r *RPC) decode(data []byte) (Sender, Destination, Receiver, []byte, error)
 	}
 	data = data[phl:]
 
+	flags := headerInt(headers[headerSignature])
+
+	var (
+		signer    Sender
+		signed    []byte
+		signature []byte
+	)
+
+	// receiver without identity can not verify signer, receiver with identity rejects unsigned envelope
+	if signed := flags&envelopeIdentity != 0; signed != (r.identity != nil) {
+		return s, d, p, []byte{}, &SignatureError{Sender: s, Destination: d}
+	}
+
+	if r.identity != nil {
+		gnl, err := r.field(data, 0, 3, 6)
+		if err != nil {
+			return s, d, p, []byte{}, &SignatureError{Sender: s, Destination: d}
+		}
+		gul, err := r.field(data, 3, 3, gnl)
+		if err != nil || len(data) < gul+ed25519.SignatureSize {
+			return s, d, p, []byte{}, &SignatureError{Sender: s, Destination: d}
+		}
+
+		signer.Name = string(data[6:gnl])
+		signer.UUID = string(data[gnl:gul])
+
+		signed = raw[:len(raw)-len(data)+gul]
+		signature = data[gul : gul+ed25519.SignatureSize]
+		data = data[gul+ed25519.SignatureSize:]
+	}
+
+	// receiver without key can not verify signed envelope, receiver with key rejects unsigned one
+	if signed := flags&envelopeHMAC != 0; signed != (r.key != nil) {
+		return s, d, p, []byte{}, &SignatureError{Sender: s, Destination: d, Signer: signer}
+	}
+
+	if r.key != nil {
+		if len(data) < sha256.Size {
+			return s, d, p, []byte{}, &SignatureError{Sender: s, Destination: d, Signer: signer}
+		}
+
+		header := raw[:len(raw)-len(data)]
+		sign := data[:sha256.Size]
+		data = data[sha256.Size:]
+
+		if !hmac.Equal(sign, r.mac(header, data)) {
+			return s, d, p, []byte{}, &SignatureError{Sender: s, Destination: d, Signer: signer}
+		}
+	}
+
+	if r.identity != nil && !r.verify(s, signer, signed, signature, data) {
+		return s, d, p, []byte{}, &SignatureError{Sender: s, Destination: d, Signer: signer}
+	}
+
 	return s, d, p, data, nil
 }
 
+// field parses length of width bytes at position at and returns end of value starting at start,
+// ERRINVALIDLENGTH is returned when length is malformed or value does not fit into data
+func (r *RPC) field(data []byte, at, width, start int) (int, error) {
+
+	if len(data) < at+width {
+		return 0, ERRINVALIDLENGTH
+	}
+
+	end, err := r.parseInt(data[at:at+width], start)
+	if err != nil || end < start || end > len(data) {
+		return 0, ERRINVALIDLENGTH
+	}
+
+	return end, nil
+}
+
 func (r *RPC) parseInt(data []byte, start int) (int, error) {
 
 	num := string(data)
@@ -203,3 +423,18 @@ func (r *RPC) parseInt(data []byte, start int) (int, error) {
 	i += start
 	return i, nil
 }
+
+// headerInt converts integer header value, AMQP decodes integers with different sizes
+func headerInt(v interface{}) int64 {
+	switch n := v.(type) {
+	case int:
+		return int64(n)
+	case int16:
+		return int64(n)
+	case int32:
+		return int64(n)
+	case int64:
+		return n
+	}
+	return 0
+}
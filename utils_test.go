@@ -1,13 +1,13 @@
 package rpc
 
 import (
-	log "github.com/Sirupsen/logrus"
+	"crypto/ed25519"
+	"crypto/rand"
 	"testing"
 )
 
 func TestSenderSign(t *testing.T) {
 
-	log.SetLevel(log.DebugLevel)
 	s := Sender{
 		Name: "demo",
 		UUID: "uuid",
@@ -120,3 +120,180 @@ func TestEncode(t *testing.T) {
 		t.Error("Failed signing proxy: expected %x, got %x", data, body)
 	}
 }
+
+func TestEncodeSigned(t *testing.T) {
+
+	r := RPC{}
+	r.token = "token"
+	r.key = []byte("secret")
+
+	s := Sender{
+		Name: "demo",
+		UUID: "uuid",
+	}
+
+	d := Destination{
+		Name:    "demo",
+		UUID:    "uuid",
+		Handler: "handler",
+	}
+
+	body, err := r.encode(s, d, Receiver{}, []byte{123, 125})
+	if err != nil {
+		t.Fatal("Failed encode:", err)
+	}
+
+	rs, rd, _, data, err := r.decode(body, r.signed(nil))
+	if err != nil {
+		t.Fatal("Failed decode:", err)
+	}
+
+	if rs != s || rd != d || string(data) != "{}" {
+		t.Errorf("Failed decode: got %v %v %s", rs, rd, data)
+	}
+
+	// tampered payload
+	body[len(body)-1] = 0
+	if _, _, _, _, err := r.decode(body, r.signed(nil)); err == nil {
+		t.Error("Expected signature error for tampered message")
+	} else if _, ok := err.(*SignatureError); !ok {
+		t.Errorf("Expected signature error, got %s", err)
+	}
+
+	// message signed with another key
+	o := RPC{token: "token", key: []byte("other")}
+	body, _ = o.encode(s, d, Receiver{}, []byte{123, 125})
+	if _, _, _, _, err := r.decode(body, o.signed(nil)); err == nil {
+		t.Error("Expected signature error for message signed with another key")
+	}
+
+	// unsigned message
+	o = RPC{token: "token"}
+	body, _ = o.encode(s, d, Receiver{}, []byte{123, 125})
+	if _, _, _, _, err := r.decode(body, o.signed(nil)); err == nil {
+		t.Error("Expected signature error for unsigned message")
+	} else if _, ok := err.(*SignatureError); !ok {
+		t.Errorf("Expected signature error for unsigned message, got %s", err)
+	}
+
+	// signed message to receiver without key
+	body, _ = r.encode(s, d, Receiver{}, []byte{123, 125})
+	if _, _, _, _, err := o.decode(body, r.signed(nil)); err == nil {
+		t.Error("Expected signature error for signed message to receiver without key")
+	} else if _, ok := err.(*SignatureError); !ok {
+		t.Errorf("Expected signature error for signed message to receiver without key, got %s", err)
+	}
+}
+
+func TestEncodeIdentity(t *testing.T) {
+
+	_, ak, _ := ed25519.GenerateKey(rand.Reader)
+	_, bk, _ := ed25519.GenerateKey(rand.Reader)
+
+	a, _ := Register("a", "uuid", "")
+	a.SetIdentity(ak)
+
+	b, _ := Register("b", "uuid", "token")
+	b.SetIdentity(bk)
+
+	d := Destination{
+		Name:    "b",
+		Handler: "handler",
+	}
+
+	body, err := a.encode(Sender{"a", "uuid"}, d, Receiver{}, []byte{123, 125})
+	if err != nil {
+		t.Fatal("Failed encode:", err)
+	}
+
+	// signer is not in trust store
+	if _, _, _, _, err := b.decode(body, a.signed(nil)); err == nil {
+		t.Error("Expected signature error for untrusted signer")
+	}
+
+	b.Trust("a", a.PublicKey())
+
+	s, _, _, data, err := b.decode(body, a.signed(nil))
+	if err != nil {
+		t.Fatal("Failed decode:", err)
+	}
+
+	if s.Name != "a" || string(data) != "{}" {
+		t.Errorf("Failed decode: got %v %s", s, data)
+	}
+
+	// application can not send messages on behalf of another one
+	body, _ = a.encode(Sender{"c", "uuid"}, d, Receiver{}, []byte{123, 125})
+	if _, _, _, _, err := b.decode(body, a.signed(nil)); err == nil {
+		t.Error("Expected signature error for impersonated sender")
+	} else if e, ok := err.(*SignatureError); !ok || e.Signer.Name != "a" {
+		t.Errorf("Expected signature error signed by a, got %s", err)
+	}
+
+	// unless it is trusted proxy
+	b.TrustProxy("a", a.PublicKey())
+	if _, _, _, _, err := b.decode(body, a.signed(nil)); err != nil {
+		t.Error("Failed decode message from trusted proxy:", err)
+	}
+
+	// tampered payload
+	body[len(body)-1] = 0
+	if _, _, _, _, err := b.decode(body, a.signed(nil)); err == nil {
+		t.Error("Expected signature error for tampered message")
+	}
+
+	// message without identity
+	c, _ := Register("c", "uuid", "token")
+	body, _ = c.encode(Sender{"c", "uuid"}, d, Receiver{}, []byte{123, 125})
+	if _, _, _, _, err := b.decode(body, c.signed(nil)); err == nil {
+		t.Error("Expected signature error for message without identity")
+	} else if _, ok := err.(*SignatureError); !ok {
+		t.Errorf("Expected signature error for message without identity, got %s", err)
+	}
+
+	// message with identity to receiver without identity
+	body, _ = b.encode(Sender{"b", "uuid"}, Destination{Name: "c"}, Receiver{}, []byte{123, 125})
+	if _, _, _, _, err := c.decode(body, b.signed(nil)); err == nil {
+		t.Error("Expected signature error for message with identity to receiver without identity")
+	} else if _, ok := err.(*SignatureError); !ok {
+		t.Errorf("Expected signature error for message with identity to receiver without identity, got %s", err)
+	}
+}
+
+func TestDecodeTruncated(t *testing.T) {
+
+	r := RPC{token: "token"}
+
+	body, _ := r.encode(Sender{"demo", "uuid"}, Destination{Name: "demo", Handler: "handler"}, Receiver{}, []byte{})
+
+	cases := [][]byte{
+		[]byte("0"),
+		[]byte("99"),
+		[]byte("-1token"),
+		[]byte("05token"),
+		[]byte("05token9\x00\x00"),
+		[]byte("05token4\x00\x00-9\x00demo"),
+	}
+	for i := 1; i < len(body); i++ {
+		cases = append(cases, body[:i])
+	}
+
+	for _, c := range cases {
+		if _, _, _, _, err := r.decode(c, nil); err != ERRINVALIDLENGTH && err != ERRINVALIDTOKEN {
+			t.Errorf("Expected error: %s for %q got %v", ERRINVALIDLENGTH, c, err)
+		}
+	}
+
+	// signature sections of truncated envelope
+	_, key, _ := ed25519.GenerateKey(rand.Reader)
+	s, _ := Register("demo", "uuid", "token")
+	s.SetIdentity(key)
+	s.SetSigningKey([]byte("secret"))
+
+	body, _ = s.encode(Sender{"demo", "uuid"}, Destination{Name: "demo"}, Receiver{}, []byte{})
+	for i := 1; i < len(body); i++ {
+		if _, _, _, _, err := s.decode(body[:i], s.signed(nil)); err == nil {
+			t.Errorf("Expected error for envelope truncated to %d bytes", i)
+		}
+	}
+}